@@ -4,6 +4,7 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"time"
 
 	"github.com/uthoplatforms/csi-utho/pkg/driver"
 )
@@ -16,6 +17,8 @@ func main() {
 		dcslug     = flag.String("dcslug", "inmumbaizone2", "Utho dcslug.")
 		driverName = flag.String("driver-name", driver.DefaultDriverName, "Name of driver")
 		debug      = flag.Bool("debug", false, "Is debug")
+		adopt      = flag.Bool("adopt-foreign-volumes", false, "Allow changing volumes not created by this cluster")
+		cacheTTL   = flag.Duration("volume-cache-ttl", 5*time.Second, "How long to reuse a listing of the account's volumes, 0 disables the cache")
 	)
 	st := ""
 	pt := &st
@@ -26,7 +29,10 @@ func main() {
 		log.Fatal("version must be defined at compilation")
 	}
 
-	d, err := driver.NewDriver(*endpoint, *token, *driverName, version, *dcslug, *debug)
+	d, err := driver.NewDriver(*endpoint, *token, *driverName, version, *dcslug, *debug,
+		driver.WithAdoptForeignVolumes(*adopt),
+		driver.WithVolumeCacheTTL(*cacheTTL),
+	)
 	if err != nil {
 		log.Fatalln(err)
 	}
@@ -0,0 +1,228 @@
+package driver
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/uthoplatforms/utho-go/utho"
+	"golang.org/x/time/rate"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+const (
+	// requests per second and burst allowed towards the Utho API, shared by every RPC
+	apiRateLimit = 10
+	apiRateBurst = 20
+
+	// reads are retried with jittered exponential backoff, writes are never retried
+	// because the API gives no way to tell whether a failed write went through
+	apiMaxRetries   = 3
+	apiRetryBackoff = 500 * time.Millisecond
+
+	// the breaker opens after this many failed requests in a row and lets a single
+	// request through once the cooldown is over to find out if the API is back.
+	// Rate limited requests don't count either way
+	apiBreakerThreshold = 5
+	apiBreakerCooldown  = 30 * time.Second
+)
+
+// errAPIUnavailable is returned without calling the API while the circuit breaker is open
+var errAPIUnavailable = errors.New("utho API is unavailable, circuit breaker is open")
+
+// apiClient is the utho.Client used by the driver. Every request, including the ones
+// made by the utho-go services, goes through its transport which rate limits, retries
+// reads, bounds each attempt by defaultTimeout and trips a circuit breaker while the
+// API is down
+type apiClient struct {
+	utho.Client
+	transport *apiTransport
+}
+
+func newAPIClient(token string) (*apiClient, error) {
+	transport := newAPITransport(http.DefaultTransport)
+
+	client, err := utho.NewClient(token, utho.WithHTTPClient(&http.Client{Transport: transport}))
+	if err != nil {
+		return nil, err
+	}
+
+	return &apiClient{Client: client, transport: transport}, nil
+}
+
+type apiTransport struct {
+	next     http.RoundTripper
+	limiter  *rate.Limiter
+	timeout  time.Duration
+	backoff  time.Duration
+	cooldown time.Duration
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+func newAPITransport(next http.RoundTripper) *apiTransport {
+	return &apiTransport{
+		next:     next,
+		limiter:  rate.NewLimiter(apiRateLimit, apiRateBurst),
+		timeout:  defaultTimeout,
+		backoff:  apiRetryBackoff,
+		cooldown: apiBreakerCooldown,
+	}
+}
+
+func (t *apiTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !t.allow() {
+		return nil, errAPIUnavailable
+	}
+
+	attempts := 1
+	if isIdempotent(req.Method) && req.Body == nil {
+		attempts += apiMaxRetries
+	}
+
+	var resp *http.Response
+	var err error
+	for attempt := 0; attempt < attempts; attempt++ {
+		if attempt > 0 {
+			backoff := wait.Jitter(t.backoff<<(attempt-1), 1.0)
+			select {
+			case <-req.Context().Done():
+				t.abandon()
+				return nil, req.Context().Err()
+			case <-time.After(backoff):
+			}
+		}
+
+		// waiting for our own rate limit says nothing about the health of the API
+		if err := t.limiter.Wait(req.Context()); err != nil {
+			t.abandon()
+			return nil, err
+		}
+
+		resp, err = t.attempt(req)
+		if !isRetryable(resp, err) {
+			break
+		}
+
+		if attempt < attempts-1 && resp != nil {
+			// drain the failed response so the connection can be reused
+			_, _ = io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+	}
+
+	// being rate limited means the API is up and answering, it is not a failure of the API
+	if errors.Is(err, context.Canceled) || isRateLimited(resp) {
+		t.abandon()
+	} else {
+		t.record(!isRetryable(resp, err))
+	}
+
+	return resp, err
+}
+
+// attempt sends the request once, bounded by the request context and the transport timeout
+func (t *apiTransport) attempt(req *http.Request) (*http.Response, error) {
+	ctx, cancel := context.WithTimeout(req.Context(), t.timeout)
+
+	resp, err := t.next.RoundTrip(req.Clone(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	// the body is read after RoundTrip returns, keep the context alive until it is closed
+	resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+
+	return resp, nil
+}
+
+// allow reports whether a request may be sent. Once the cooldown of an open breaker is
+// over a single request is let through, its outcome closes or reopens the breaker
+func (t *apiTransport) allow() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.failures < apiBreakerThreshold {
+		return true
+	}
+
+	if time.Now().Before(t.openUntil) || t.probing {
+		return false
+	}
+
+	t.probing = true
+	return true
+}
+
+func (t *apiTransport) record(success bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.probing = false
+
+	if success {
+		t.failures = 0
+		return
+	}
+
+	t.failures++
+	if t.failures >= apiBreakerThreshold {
+		t.openUntil = time.Now().Add(t.cooldown)
+	}
+}
+
+// abandon lets another request probe the API when this one gave up before getting an answer
+func (t *apiTransport) abandon() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.probing = false
+}
+
+func (t *apiTransport) available() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.failures < apiBreakerThreshold || !time.Now().Before(t.openUntil)
+}
+
+func isIdempotent(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead
+}
+
+// isRetryable reports whether the attempt failed in a way that may go away on its own,
+// errors the API answered with on purpose are left to the caller
+func isRetryable(resp *http.Response, err error) bool {
+	if err != nil {
+		return !errors.Is(err, context.Canceled)
+	}
+
+	return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= http.StatusInternalServerError
+}
+
+// isRateLimited reports whether the API asked to slow down, with a 429 or a Retry-After
+func isRateLimited(resp *http.Response) bool {
+	if resp == nil {
+		return false
+	}
+
+	return resp.StatusCode == http.StatusTooManyRequests || resp.Header.Get("Retry-After") != ""
+}
+
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
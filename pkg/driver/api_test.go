@@ -0,0 +1,290 @@
+package driver
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/sirupsen/logrus"
+	"github.com/uthoplatforms/utho-go/utho"
+	"golang.org/x/time/rate"
+)
+
+// newTestTransport returns a transport without rate limit and with short backoffs
+func newTestTransport() *apiTransport {
+	transport := newAPITransport(http.DefaultTransport)
+	transport.limiter = rate.NewLimiter(rate.Inf, 0)
+	transport.backoff = time.Millisecond
+	transport.cooldown = 50 * time.Millisecond
+	return transport
+}
+
+// countingServer answers every request with statusCode and counts the requests
+func countingServer(t *testing.T, statusCode int) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+
+	var hits atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.WriteHeader(statusCode)
+	}))
+	t.Cleanup(server.Close)
+
+	return server, &hits
+}
+
+func send(t *testing.T, transport *apiTransport, method, url string) (*http.Response, error) {
+	t.Helper()
+
+	var body io.Reader
+	if method != http.MethodGet {
+		body = strings.NewReader("{}")
+	}
+
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		t.Fatalf("cannot build request: %v", err)
+	}
+
+	resp, err := transport.RoundTrip(req)
+	if resp != nil {
+		resp.Body.Close()
+	}
+	return resp, err
+}
+
+func TestAPITransportRetries(t *testing.T) {
+	tests := []struct {
+		name       string
+		method     string
+		statusCode int
+		wantHits   int32
+	}{
+		{name: "retries reads on server errors", method: http.MethodGet, statusCode: http.StatusServiceUnavailable, wantHits: 1 + apiMaxRetries},
+		{name: "retries reads when rate limited", method: http.MethodGet, statusCode: http.StatusTooManyRequests, wantHits: 1 + apiMaxRetries},
+		{name: "does not retry writes", method: http.MethodPost, statusCode: http.StatusServiceUnavailable, wantHits: 1},
+		{name: "does not retry deletes", method: http.MethodDelete, statusCode: http.StatusServiceUnavailable, wantHits: 1},
+		{name: "does not retry client errors", method: http.MethodGet, statusCode: http.StatusNotFound, wantHits: 1},
+		{name: "does not retry successful reads", method: http.MethodGet, statusCode: http.StatusOK, wantHits: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, hits := countingServer(t, tt.statusCode)
+
+			resp, err := send(t, newTestTransport(), tt.method, server.URL)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if resp.StatusCode != tt.statusCode {
+				t.Errorf("got status %d, want %d", resp.StatusCode, tt.statusCode)
+			}
+			if got := hits.Load(); got != tt.wantHits {
+				t.Errorf("server got %d requests, want %d", got, tt.wantHits)
+			}
+		})
+	}
+}
+
+func TestAPITransportStopsRetryingWhenTheContextIsDone(t *testing.T) {
+	server, hits := countingServer(t, http.StatusServiceUnavailable)
+
+	transport := newTestTransport()
+	transport.backoff = time.Minute
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL, nil)
+	if err != nil {
+		t.Fatalf("cannot build request: %v", err)
+	}
+
+	if _, err := transport.RoundTrip(req); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got error %v, want %v", err, context.DeadlineExceeded)
+	}
+	if got := hits.Load(); got != 1 {
+		t.Errorf("server got %d requests, want 1", got)
+	}
+}
+
+func TestAPITransportCircuitBreaker(t *testing.T) {
+	server, hits := countingServer(t, http.StatusServiceUnavailable)
+	transport := newTestTransport()
+
+	for i := 0; i < apiBreakerThreshold; i++ {
+		if _, err := send(t, transport, http.MethodPost, server.URL); err != nil {
+			t.Fatalf("request %d: unexpected error: %v", i, err)
+		}
+	}
+
+	if transport.available() {
+		t.Fatal("breaker is closed after the threshold of failures")
+	}
+
+	if _, err := send(t, transport, http.MethodPost, server.URL); !errors.Is(err, errAPIUnavailable) {
+		t.Fatalf("got error %v while the breaker is open, want %v", err, errAPIUnavailable)
+	}
+	if got := hits.Load(); got != apiBreakerThreshold {
+		t.Fatalf("server got %d requests, the open breaker let one through", got)
+	}
+}
+
+func TestAPITransportRateLimitedResponsesDoNotOpenTheBreaker(t *testing.T) {
+	tests := []struct {
+		name       string
+		statusCode int
+		retryAfter string
+	}{
+		{name: "too many requests", statusCode: http.StatusTooManyRequests},
+		{name: "unavailable with a retry after", statusCode: http.StatusServiceUnavailable, retryAfter: "1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tt.retryAfter != "" {
+					w.Header().Set("Retry-After", tt.retryAfter)
+				}
+				w.WriteHeader(tt.statusCode)
+			}))
+			t.Cleanup(server.Close)
+
+			transport := newTestTransport()
+			for i := 0; i < 2*apiBreakerThreshold; i++ {
+				if _, err := send(t, transport, http.MethodPost, server.URL); err != nil {
+					t.Fatalf("request %d: unexpected error: %v", i, err)
+				}
+			}
+
+			if !transport.available() {
+				t.Fatal("breaker opened on rate limited responses")
+			}
+		})
+	}
+}
+
+func TestAPITransportProbesOnceAfterTheCooldown(t *testing.T) {
+	release := make(chan struct{})
+	var hits atomic.Int32
+	var healthy atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		if !healthy.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		<-release
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(server.Close)
+
+	transport := newTestTransport()
+	for i := 0; i < apiBreakerThreshold; i++ {
+		if _, err := send(t, transport, http.MethodPost, server.URL); err != nil {
+			t.Fatalf("request %d: unexpected error: %v", i, err)
+		}
+	}
+
+	time.Sleep(2 * transport.cooldown)
+	healthy.Store(true)
+
+	probe := make(chan error, 1)
+	go func() {
+		_, err := send(t, transport, http.MethodPost, server.URL)
+		probe <- err
+	}()
+
+	// wait for the probe to reach the server
+	deadline := time.Now().Add(5 * time.Second)
+	for hits.Load() != apiBreakerThreshold+1 {
+		if time.Now().After(deadline) {
+			t.Fatal("the probe did not reach the server")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if _, err := send(t, transport, http.MethodPost, server.URL); !errors.Is(err, errAPIUnavailable) {
+		t.Fatalf("got error %v while probing, want %v", err, errAPIUnavailable)
+	}
+
+	close(release)
+	if err := <-probe; err != nil {
+		t.Fatalf("probe failed: %v", err)
+	}
+
+	if !transport.available() {
+		t.Fatal("breaker is still open after a successful probe")
+	}
+	if _, err := send(t, transport, http.MethodPost, server.URL); err != nil {
+		t.Fatalf("request after the probe failed: %v", err)
+	}
+}
+
+func TestBlockStorageRequestsUseTheCallerContext(t *testing.T) {
+	done := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-done:
+		}
+	}))
+	t.Cleanup(server.Close)
+	t.Cleanup(func() { close(done) })
+
+	client, err := utho.NewClient("token",
+		utho.WithBaseURL(server.URL),
+		utho.WithHTTPClient(&http.Client{Transport: newTestTransport()}),
+	)
+	if err != nil {
+		t.Fatalf("cannot create client: %v", err)
+	}
+	storage := newUthoBlockStorage(client)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if _, err := storage.GetVolume(ctx, "vol-1"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got error %v, want %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("GetVolume returned after %v, the request outlived its context", elapsed)
+	}
+}
+
+func TestProbeIsReadyWhileTheBreakerIsOpen(t *testing.T) {
+	server, _ := countingServer(t, http.StatusServiceUnavailable)
+
+	transport := newTestTransport()
+	d := &UthoDriver{
+		log:    logrus.NewEntry(logrus.New()),
+		client: &apiClient{transport: transport},
+	}
+	identity := NewUthoIdentityServer(d)
+
+	for i := 0; i < apiBreakerThreshold; i++ {
+		if _, err := send(t, transport, http.MethodPost, server.URL); err != nil {
+			t.Fatalf("request %d: unexpected error: %v", i, err)
+		}
+	}
+	if transport.available() {
+		t.Fatal("breaker is closed after the threshold of failures")
+	}
+
+	// livenessprobe would restart the plugin, which does nothing for the API
+	res, err := identity.Probe(context.Background(), &csi.ProbeRequest{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !res.Ready.GetValue() {
+		t.Fatal("probe is not ready while the breaker is open")
+	}
+}
@@ -0,0 +1,106 @@
+package driver
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// defaultVolumeCacheTTL is how long a listing of the account's volumes is reused
+const defaultVolumeCacheTTL = 5 * time.Second
+
+// volumeCache holds the last listing of the account's EBS volumes for a short time.
+// Concurrent callers share a single in-flight List call, and every change the driver
+// makes to a volume invalidates the listing so it never serves its own stale writes
+type volumeCache struct {
+	ttl time.Duration
+
+	mu         sync.Mutex
+	volumes    []Volume
+	valid      bool
+	fetchedAt  time.Time
+	generation uint64
+	inFlight   *volumeFetch
+}
+
+// volumeFetch is a List call that callers arriving while it runs wait on, as long as
+// nothing was invalidated since it started
+type volumeFetch struct {
+	generation uint64
+	done       chan struct{}
+	volumes    []Volume
+	err        error
+}
+
+func newVolumeCache(ttl time.Duration) *volumeCache {
+	return &volumeCache{ttl: ttl}
+}
+
+// list returns the account's volumes, from the cache when the last listing is fresh enough.
+// The List call isn't bound to the caller that started it, callers that give up don't
+// fail the others waiting on it
+func (vc *volumeCache) list(ctx context.Context, storage BlockStorage) ([]Volume, error) {
+	vc.mu.Lock()
+	if vc.valid && time.Since(vc.fetchedAt) < vc.ttl {
+		volumes := copyVolumes(vc.volumes)
+		vc.mu.Unlock()
+		return volumes, nil
+	}
+
+	// a call that started before the last invalidation may miss the change, callers
+	// arriving after it must not get its listing
+	fetch := vc.inFlight
+	if fetch == nil || fetch.generation != vc.generation {
+		fetch = &volumeFetch{generation: vc.generation, done: make(chan struct{})}
+		vc.inFlight = fetch
+		go vc.fetch(context.WithoutCancel(ctx), storage, fetch)
+	}
+	vc.mu.Unlock()
+
+	select {
+	case <-fetch.done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return copyVolumes(fetch.volumes), fetch.err
+}
+
+// fetch runs the List call of fetch, bounded by defaultTimeout, and caches its listing
+// unless something was invalidated since it started
+func (vc *volumeCache) fetch(ctx context.Context, storage BlockStorage, fetch *volumeFetch) {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	fetch.volumes, fetch.err = storage.ListVolumes(ctx)
+
+	vc.mu.Lock()
+	if vc.inFlight == fetch {
+		vc.inFlight = nil
+	}
+	if fetch.err == nil && fetch.generation == vc.generation {
+		vc.volumes = fetch.volumes
+		vc.valid = true
+		vc.fetchedAt = time.Now()
+	}
+	vc.mu.Unlock()
+	close(fetch.done)
+}
+
+// invalidate drops the cached listing, the next list goes to the API
+func (vc *volumeCache) invalidate() {
+	vc.mu.Lock()
+	defer vc.mu.Unlock()
+
+	vc.volumes = nil
+	vc.valid = false
+	vc.generation++
+}
+
+// copyVolumes keeps callers from modifying the cached listing
+func copyVolumes(volumes []Volume) []Volume {
+	if volumes == nil {
+		return nil
+	}
+
+	return append([]Volume(nil), volumes...)
+}
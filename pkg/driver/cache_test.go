@@ -0,0 +1,88 @@
+package driver
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// listingStorage is a BlockStorage that only implements ListVolumes
+type listingStorage struct {
+	BlockStorage
+	calls   atomic.Int32
+	release chan struct{}
+	volumes []Volume
+}
+
+func (s *listingStorage) ListVolumes(ctx context.Context) ([]Volume, error) {
+	s.calls.Add(1)
+	if s.release != nil {
+		select {
+		case <-s.release:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	return s.volumes, nil
+}
+
+func TestVolumeCacheCancelledCallerDoesNotFailTheOthers(t *testing.T) {
+	storage := &listingStorage{release: make(chan struct{}), volumes: []Volume{{}}}
+	cache := newVolumeCache(time.Minute)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	first := make(chan error, 1)
+	go func() {
+		_, err := cache.list(ctx, storage)
+		first <- err
+	}()
+	for storage.calls.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	second := make(chan error, 1)
+	go func() {
+		volumes, err := cache.list(context.Background(), storage)
+		if err == nil && len(volumes) != 1 {
+			err = errors.New("got no volumes")
+		}
+		second <- err
+	}()
+
+	cancel()
+	if err := <-first; !errors.Is(err, context.Canceled) {
+		t.Errorf("cancelled caller got %v, want %v", err, context.Canceled)
+	}
+
+	close(storage.release)
+	if err := <-second; err != nil {
+		t.Errorf("waiting caller failed: %v", err)
+	}
+	if calls := storage.calls.Load(); calls != 1 {
+		t.Errorf("listed %d times, want once", calls)
+	}
+}
+
+func TestVolumeCacheCachesAnEmptyListing(t *testing.T) {
+	storage := &listingStorage{}
+	cache := newVolumeCache(time.Minute)
+
+	for i := 0; i < 2; i++ {
+		if _, err := cache.list(context.Background(), storage); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if calls := storage.calls.Load(); calls != 1 {
+		t.Errorf("listed %d times, want once", calls)
+	}
+
+	cache.invalidate()
+	if _, err := cache.list(context.Background(), storage); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if calls := storage.calls.Load(); calls != 2 {
+		t.Errorf("listed %d times after invalidating, want twice", calls)
+	}
+}
@@ -0,0 +1,57 @@
+package driver
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/uthoplatforms/utho-go/utho"
+)
+
+// Clusters looks up the Utho Kubernetes clusters the driver runs in
+type Clusters interface {
+	// NodeID returns the cloud ID volumes are attached to for the worker of the
+	// nodepool with the given hostname
+	NodeID(clusterID, nodepoolID, hostname string) (string, error)
+	// Dcslug returns the datacenter of the cluster
+	Dcslug(clusterID string) (string, error)
+}
+
+var _ Clusters = &uthoClusters{}
+
+// uthoClusters is the Clusters of a Utho account
+type uthoClusters struct {
+	client utho.Client
+}
+
+func newUthoClusters(client utho.Client) *uthoClusters {
+	return &uthoClusters{client: client}
+}
+
+func (c *uthoClusters) NodeID(clusterID, nodepoolID, hostname string) (string, error) {
+	k8s, err := c.client.Kubernetes().Read(clusterID)
+	if err != nil {
+		return "", fmt.Errorf("error retrieving Kubernetes with id '%s' %w", clusterID, err)
+	}
+
+	nodepool, exists := k8s.Nodepools[nodepoolID]
+	if !exists {
+		return "", fmt.Errorf("nodepool '%s' not found in cluster '%s'", nodepoolID, clusterID)
+	}
+
+	for _, node := range nodepool.Workers {
+		if strings.EqualFold(node.Hostname, hostname) {
+			return node.Cloudid, nil
+		}
+	}
+
+	return "", fmt.Errorf("node with name '%s' does not exist in the NodePool '%s'", hostname, nodepoolID)
+}
+
+func (c *uthoClusters) Dcslug(clusterID string) (string, error) {
+	cluster, err := c.client.Kubernetes().Read(clusterID)
+	if err != nil {
+		return "", fmt.Errorf("unable to get kubernetes info: %v", err)
+	}
+
+	return cluster.Info.Cluster.Dcslug, nil
+}
@@ -0,0 +1,155 @@
+package driver_test
+
+import (
+	"context"
+	"testing"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/uthoplatforms/csi-utho/pkg/driver"
+	"github.com/uthoplatforms/csi-utho/pkg/fake"
+	"google.golang.org/grpc/codes"
+)
+
+func TestLookupNodeID(t *testing.T) {
+	cloud := fake.NewCloud()
+	cloud.AddCluster("cluster-1", testDcslug)
+	if err := cloud.AddNodepool("cluster-1", "pool-1",
+		fake.Worker{Hostname: "worker-1", Cloudid: "1001"},
+		fake.Worker{Hostname: "worker-2", Cloudid: "1002"},
+	); err != nil {
+		t.Fatalf("cannot add nodepool: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		nodeName string
+		labels   map[string]string
+		want     string
+		wantErr  bool
+	}{
+		{
+			name:     "finds the worker by hostname",
+			nodeName: "WORKER-2",
+			labels:   map[string]string{"cluster_id": "cluster-1", "nodepool_id": "pool-1"},
+			want:     "1002",
+		},
+		{
+			name:     "unknown worker",
+			nodeName: "worker-3",
+			labels:   map[string]string{"cluster_id": "cluster-1", "nodepool_id": "pool-1"},
+			wantErr:  true,
+		},
+		{
+			name:     "unknown nodepool",
+			nodeName: "worker-1",
+			labels:   map[string]string{"cluster_id": "cluster-1", "nodepool_id": "pool-2"},
+			wantErr:  true,
+		},
+		{
+			name:     "missing cluster label",
+			nodeName: "worker-1",
+			labels:   map[string]string{"nodepool_id": "pool-1"},
+			wantErr:  true,
+		},
+		{
+			name:     "missing nodepool label",
+			nodeName: "worker-1",
+			labels:   map[string]string{"cluster_id": "cluster-1"},
+			wantErr:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := driver.LookupNodeID(cloud, tt.nodeName, tt.labels)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("got node id %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCreateVolumeTopologyOfTheCluster(t *testing.T) {
+	topology := func(region string) *csi.Topology {
+		return &csi.Topology{Segments: map[string]string{"region": region}}
+	}
+
+	tests := []struct {
+		name         string
+		params       map[string]string
+		requirements *csi.TopologyRequirement
+		code         codes.Code
+		wantDcslug   string
+	}{
+		{
+			name:       "uses the datacenter of the cluster",
+			code:       codes.OK,
+			wantDcslug: "innoida",
+		},
+		{
+			name:         "prefers the preferred topology",
+			requirements: &csi.TopologyRequirement{Preferred: []*csi.Topology{topology("inbangalore")}, Requisite: []*csi.Topology{topology("innoida"), topology("inbangalore")}},
+			code:         codes.OK,
+			wantDcslug:   "inbangalore",
+		},
+		{
+			name:         "falls back to the requisite topology",
+			requirements: &csi.TopologyRequirement{Requisite: []*csi.Topology{topology("inbangalore")}},
+			code:         codes.OK,
+			wantDcslug:   "inbangalore",
+		},
+		{
+			name:         "uses the storage class datacenter allowed by the topology",
+			params:       map[string]string{"dcslug": "inbangalore"},
+			requirements: &csi.TopologyRequirement{Requisite: []*csi.Topology{topology("innoida"), topology("inbangalore")}},
+			code:         codes.OK,
+			wantDcslug:   "inbangalore",
+		},
+		{
+			name:         "rejects a storage class datacenter outside the topology",
+			params:       map[string]string{"dcslug": "inbangalore"},
+			requirements: &csi.TopologyRequirement{Requisite: []*csi.Topology{topology("innoida")}},
+			code:         codes.InvalidArgument,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cloud := fake.NewCloud()
+			cloud.AddCluster("cluster-1", "innoida")
+
+			d, err := driver.NewDriver("unix:///tmp/csi.sock", "", driver.DefaultDriverName, "test", "", true,
+				driver.WithBlockStorage(cloud),
+				driver.WithClusters(cloud),
+				driver.WithClusterID("cluster-1"),
+				driver.WithVolumeCacheTTL(0),
+			)
+			if err != nil {
+				t.Fatalf("cannot create driver: %v", err)
+			}
+			controller := driver.NewUthoControllerServer(d)
+
+			res, err := controller.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+				Name:                      "pvc-1",
+				VolumeCapabilities:        mountCapabilities(),
+				Parameters:                tt.params,
+				AccessibilityRequirements: tt.requirements,
+			})
+			checkCode(t, err, tt.code)
+			if err != nil {
+				return
+			}
+
+			volume, _ := cloud.Volume(res.Volume.VolumeId)
+			if volume.Location.Dc != tt.wantDcslug {
+				t.Errorf("volume created in %q, want %q", volume.Location.Dc, tt.wantDcslug)
+			}
+			if region := res.Volume.AccessibleTopology[0].Segments["region"]; region != tt.wantDcslug {
+				t.Errorf("topology region %q, want %q", region, tt.wantDcslug)
+			}
+		})
+	}
+}
@@ -2,15 +2,23 @@ package driver
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"math"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	csi "github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/sirupsen/logrus"
 	"github.com/uthoplatforms/utho-go/utho"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+	"k8s.io/apimachinery/pkg/util/wait"
 )
 
 type ControllerServer struct {
@@ -39,7 +47,30 @@ const (
 	defaultVolumeSizeInBytes int64 = 16 * giB
 )
 
+const (
+	// uthoTimeLayout is the timestamp format used by the Utho API
+	uthoTimeLayout = "2006-01-02 15:04:05"
+
+	// snapshotStatusReady is the status Utho reports once a snapshot can be restored
+	snapshotStatusReady = "Active"
+
+	// detachedCloudID is the cloudid Utho reports for a volume that isn't attached
+	detachedCloudID = "0"
+
+	// volumeStatusCheckInterval is the first delay when waiting for an attach or
+	// detach, it doubles on every check up to volumeStatusCheckMaxInterval
+	volumeStatusCheckInterval    = 1 * time.Second
+	volumeStatusCheckMaxInterval = 10 * time.Second
+
+	// volumeAttachingStuckTimeout is how long a volume may stay attaching
+	// before its condition is reported as abnormal
+	volumeAttachingStuckTimeout = 5 * time.Minute
+)
+
 var (
+	// volumeStatusesInProgress are the statuses of a volume Utho is still creating or restoring
+	volumeStatusesInProgress = []string{"pending", "creating", "restoring"}
+
 	supportedVolCapabilities = &csi.VolumeCapability_AccessMode{
 		Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
 	}
@@ -51,11 +82,26 @@ var _ csi.ControllerServer = &UthoControllerServer{}
 type UthoControllerServer struct {
 	csi.UnimplementedControllerServer
 	Driver *UthoDriver
+
+	// attachments are the attaches and detaches requested from Utho that haven't
+	// completed yet, by volume ID. The API doesn't report them until the cloudid
+	// of the volume changes, so retries after a timeout pick them up from here
+	attachmentsMu sync.Mutex
+	attachments   map[string]attachment
+}
+
+// attachment is an attach to nodeID, or a detach when nodeID is detachedCloudID
+type attachment struct {
+	nodeID string
+	since  time.Time
 }
 
 // NewUthoControllerServer returns a UthoControllerServer
 func NewUthoControllerServer(driver *UthoDriver) *UthoControllerServer {
-	return &UthoControllerServer{Driver: driver}
+	return &UthoControllerServer{
+		Driver:      driver,
+		attachments: map[string]attachment{},
+	}
 }
 
 // CreateVolume provisions a new volume on behalf of the user
@@ -67,37 +113,107 @@ func (c *UthoControllerServer) CreateVolume(ctx context.Context, req *csi.Create
 	if len(req.VolumeCapabilities) == 0 {
 		return nil, status.Error(codes.InvalidArgument, "CreateVolume Volume Capabilities is missing")
 	}
-	if req.Parameters["iops"] == "" {
-		return nil, status.Error(codes.InvalidArgument, "CreateVolume Volume parameter `iops` is missing")
-	}
-	if req.Parameters["throughput"] == "" {
-		return nil, status.Error(codes.InvalidArgument, "CreateVolume Volume parameter `throughput` is missing")
-	}
 
 	// Validate
 	if !isValidCapability(req.VolumeCapabilities) {
 		return nil, status.Errorf(codes.InvalidArgument, "CreateVolume Volume capability is not compatible: %v", req)
 	}
 
+	scParams, metadata := extractMetadata(req.Parameters)
+	volParams, err := parseVolumeParameters(scParams, req.MutableParameters)
+	if err != nil {
+		return nil, err
+	}
+
 	size, err := extractStorage(req.CapacityRange)
 	if err != nil {
 		return nil, status.Errorf(codes.OutOfRange, "invalid capacity range: %v", err)
 	}
 
+	dcslug, err := c.pickDcslug(volParams.dcslug, req.AccessibilityRequirements)
+	if err != nil {
+		return nil, err
+	}
+
 	c.Driver.log.WithFields(logrus.Fields{
-		"volume-name":  volName,
-		"size":         size,
-		"capabilities": req.VolumeCapabilities,
+		"volume-name":    volName,
+		"size":           size,
+		"dcslug":         dcslug,
+		"parameters":     volParams,
+		"pvc-namespace":  metadata.pvcNamespace,
+		"pvc-name":       metadata.pvcName,
+		"capabilities":   req.VolumeCapabilities,
+		"content-source": req.VolumeContentSource,
 	}).Info("Create Volume: called")
 
+	unlock, err := c.Driver.lock(lockVolumeName, volName)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	var snapshotID, cloneSourceID string
+	var snapshotSize int64
+	if contentSource := req.VolumeContentSource; contentSource != nil {
+		switch {
+		case contentSource.GetSnapshot() != nil:
+			snapshotID = contentSource.GetSnapshot().GetSnapshotId()
+			snapshotSize, err = c.snapshotSourceSize(ctx, snapshotID)
+			if err != nil {
+				return nil, err
+			}
+
+			// the restored volume can't be smaller than the snapshot it comes from
+			if size < snapshotSize {
+				if limit := req.CapacityRange.GetLimitBytes(); limit > 0 && limit < snapshotSize {
+					return nil, status.Errorf(codes.OutOfRange, "snapshot %s size (%v) exceeds the capacity limit (%v)", snapshotID, formatBytes(snapshotSize), formatBytes(limit))
+				}
+				size = snapshotSize
+			}
+		case contentSource.GetVolume() != nil:
+			cloneSourceID = contentSource.GetVolume().GetVolumeId()
+			sourceSize, err := c.cloneSourceSize(ctx, cloneSourceID, dcslug)
+			if err != nil {
+				return nil, err
+			}
+
+			// the internal snapshot of the clone is created and deleted by name like any other
+			unlockSnapshot, err := c.Driver.lock(lockSnapshotName, cloneSnapshotName(volName))
+			if err != nil {
+				return nil, err
+			}
+			defer unlockSnapshot()
+
+			// without a capacity range the clone gets the size of its source
+			if req.CapacityRange == nil {
+				size = sourceSize
+			}
+			if size < sourceSize {
+				return nil, status.Errorf(codes.OutOfRange, "clone size (%v) can not be smaller than source volume %s (%v)", formatBytes(size), cloneSourceID, formatBytes(sourceSize))
+			}
+		default:
+			return nil, status.Errorf(codes.InvalidArgument, "CreateVolume content source %v is not supported", contentSource)
+		}
+	}
+
+	sizeGB, err := volumeSizeGB(size, req.CapacityRange)
+	if err != nil {
+		return nil, err
+	}
+	size = int64(sizeGB) * giB
+
 	// check that the volume doesn't already exist
-	volumes, err := c.Driver.client.Ebs().List()
+	ebsName := c.Driver.ebsName(volName, metadata)
+	volumes, err := c.Driver.volumeCache.list(ctx, c.Driver.storage)
 	if err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
+		return nil, uthoStatus(err, "cannot list volumes")
 	}
 
 	for _, volume := range volumes {
-		if volume.Name == volName {
+		// another cluster sharing the token may use the same name, volumes created before
+		// names were prefixed are still named volName, or carry no PVC when the provisioner
+		// didn't pass it
+		if (volume.Name == ebsName || volume.Name == volName || volume.Name == c.Driver.ebsName(volName, volumeMetadata{})) && c.Driver.ownsVolume(volume) {
 			byteSize, err := strconv.ParseFloat(volume.Size, 64)
 			if err != nil {
 				return nil, status.Error(codes.Internal, err.Error())
@@ -110,46 +226,308 @@ func (c *UthoControllerServer) CreateVolume(ctx context.Context, req *csi.Create
 				return nil, status.Error(codes.AlreadyExists, "Volume with the same name but different volume already exists")
 			}
 
+			if volume.Location.Dc != "" && !strings.EqualFold(volume.Location.Dc, dcslug) {
+				return nil, status.Errorf(codes.AlreadyExists, "Volume with the same name already exists in datacenter %s", volume.Location.Dc)
+			}
+
+			// an earlier call may have created the clone without getting to drop its snapshot
+			if cloneSourceID != "" {
+				if err := c.finishClone(ctx, volName, cloneSourceID, volume.ID); err != nil {
+					return nil, err
+				}
+			}
+
 			return &csi.CreateVolumeResponse{
 				Volume: &csi.Volume{
-					VolumeId:      volume.ID,
-					CapacityBytes: int64(byteSize) * giB,
+					VolumeId:           volume.ID,
+					CapacityBytes:      int64(byteSize) * giB,
+					VolumeContext:      volumeContext(volParams),
+					ContentSource:      req.VolumeContentSource,
+					AccessibleTopology: volumeTopology(dcslug),
 				},
 			}, nil
 		}
 	}
 
+	// utho has no native clone, so clones are restored from an internal snapshot of the source
+	if cloneSourceID != "" {
+		snapshotID, err = c.cloneSnapshot(ctx, volName, cloneSourceID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	// if applicable, create volume
-	params := utho.CreateEBSParams{
-		Name:       volName,
-		Dcslug:     c.Driver.dcslug,
-		Disk:       strconv.Itoa(bytesToGB(size)),
-		Iops:       req.Parameters["iops"],
-		Throughput: req.Parameters["throughput"],
-		DiskType:   "SSD",
+	params := CreateVolumeParams{
+		CreateEBSParams: utho.CreateEBSParams{
+			Name:       ebsName,
+			Dcslug:     dcslug,
+			Disk:       strconv.Itoa(sizeGB),
+			Iops:       strconv.Itoa(volParams.iops),
+			Throughput: strconv.Itoa(volParams.throughput),
+			DiskType:   volParams.diskType,
+		},
+		SnapshotID: snapshotID,
 	}
-	ebsCreateRes, err := c.Driver.client.Ebs().Create(params)
+	volumeID, err := c.Driver.storage.CreateVolume(ctx, params)
+	c.Driver.volumeCache.invalidate()
 	if err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
+		// the snapshot would leak if the PVC goes away before a retry, drop it unless the
+		// volume may have been created anyway and is being restored from it
+		if cloneSourceID != "" && isUthoRejected(err) {
+			if err := c.Driver.storage.DeleteSnapshot(ctx, cloneSourceID, snapshotID); err != nil && !isUthoNotFound(err) {
+				c.Driver.log.WithFields(logrus.Fields{
+					"snapshot-id": snapshotID,
+					"volume-name": volName,
+				}).Warnf("Create Volume: cannot delete clone snapshot: %v", err)
+			}
+		}
+		return nil, uthoStatus(err, "cannot create volume")
 	}
 
 	res := &csi.CreateVolumeResponse{
 		Volume: &csi.Volume{
-			VolumeId:      ebsCreateRes.ID,
-			CapacityBytes: size,
+			VolumeId:           volumeID,
+			CapacityBytes:      size,
+			VolumeContext:      volumeContext(volParams),
+			ContentSource:      req.VolumeContentSource,
+			AccessibleTopology: volumeTopology(dcslug),
 		},
 	}
 
+	if snapshotID != "" && cloneSourceID == "" {
+		if err := c.checkRestore(ctx, volumeID, snapshotID, snapshotSize); err != nil {
+			return nil, err
+		}
+	}
+
+	if cloneSourceID != "" {
+		if err := c.finishClone(ctx, volName, cloneSourceID, volumeID); err != nil {
+			return nil, err
+		}
+	}
+
 	c.Driver.log.WithFields(logrus.Fields{
-		"size":        size,
-		"volume-id":   ebsCreateRes.ID,
-		"volume-name": volName,
-		"volume-size": size,
+		"size":             size,
+		"volume-id":        volumeID,
+		"volume-name":      volName,
+		"volume-size":      size,
+		"snapshot-id":      snapshotID,
+		"source-volume-id": cloneSourceID,
 	}).Info("Create Volume: created volume")
 
 	return res, nil
 }
 
+// pickDcslug returns the datacenter to create a volume in. A dcslug set on the StorageClass
+// wins as long as the CO allows it, then preferred topologies, then requisite ones, and the
+// driver's own datacenter is used when the CO has no requirement
+func (c *UthoControllerServer) pickDcslug(scDcslug string, requirements *csi.TopologyRequirement) (string, error) {
+	if scDcslug != "" {
+		requisite := requirements.GetRequisite()
+		for _, topology := range requisite {
+			if strings.EqualFold(topology.GetSegments()[topologyRegionKey], scDcslug) {
+				return scDcslug, nil
+			}
+		}
+
+		if len(requisite) > 0 {
+			return "", status.Errorf(codes.InvalidArgument, "invalid StorageClass parameter %q: %s is not in the requisite topologies %v",
+				paramDcslug, scDcslug, requisite)
+		}
+
+		return scDcslug, nil
+	}
+
+	for _, topology := range requirements.GetPreferred() {
+		if region := topology.GetSegments()[topologyRegionKey]; region != "" {
+			return region, nil
+		}
+	}
+
+	for _, topology := range requirements.GetRequisite() {
+		if region := topology.GetSegments()[topologyRegionKey]; region != "" {
+			return region, nil
+		}
+	}
+
+	return c.Driver.dcslug, nil
+}
+
+// volumeTopology is the topology a volume in the given datacenter is accessible from
+func volumeTopology(dcslug string) []*csi.Topology {
+	return []*csi.Topology{
+		{
+			Segments: map[string]string{
+				topologyRegionKey: dcslug,
+			},
+		},
+	}
+}
+
+// snapshotSourceSize looks up the snapshot a volume is restored from and returns its size
+func (c *UthoControllerServer) snapshotSourceSize(ctx context.Context, snapshotID string) (int64, error) {
+	if snapshotID == "" {
+		return 0, status.Error(codes.InvalidArgument, "CreateVolume snapshot source ID is missing")
+	}
+
+	snapshots, err := c.Driver.storage.ListSnapshots(ctx)
+	if err != nil {
+		return 0, uthoStatus(err, "cannot list snapshots")
+	}
+
+	for _, snapshot := range snapshots {
+		if snapshot.ID != snapshotID {
+			continue
+		}
+
+		if !strings.EqualFold(snapshot.Status, snapshotStatusReady) {
+			return 0, status.Errorf(codes.Unavailable, "snapshot %s is not ready to use yet", snapshotID)
+		}
+
+		size, err := ebsSizeInBytes(snapshot.Size)
+		if err != nil {
+			return 0, status.Errorf(codes.Internal, "invalid size %q for snapshot %s: %v", snapshot.Size, snapshotID, err)
+		}
+
+		return size, nil
+	}
+
+	return 0, status.Errorf(codes.NotFound, "snapshot %s not found", snapshotID)
+}
+
+// checkRestore reads back a volume restored from a snapshot before it is reported created.
+// The API doesn't report which snapshot a volume was restored from, so the volume has to
+// exist and hold at least the snapshot
+func (c *UthoControllerServer) checkRestore(ctx context.Context, volumeID, snapshotID string, snapshotSize int64) error {
+	volume, err := c.Driver.storage.GetVolume(ctx, volumeID)
+	if err != nil {
+		if isUthoNotFound(err) {
+			return status.Errorf(codes.Aborted, "volume %s restored from snapshot %s is gone", volumeID, snapshotID)
+		}
+		return uthoStatus(err, "cannot get restored volume "+volumeID)
+	}
+
+	size, err := ebsSizeInBytes(volume.Size)
+	if err != nil {
+		return status.Errorf(codes.Internal, "invalid size %q for volume %s: %v", volume.Size, volumeID, err)
+	}
+	if size < snapshotSize {
+		return status.Errorf(codes.Internal, "volume %s (%v) is smaller than snapshot %s (%v) it was restored from",
+			volumeID, formatBytes(size), snapshotID, formatBytes(snapshotSize))
+	}
+
+	return nil
+}
+
+// cloneSourceSize checks that the volume to clone exists in the datacenter of the clone and returns its size
+func (c *UthoControllerServer) cloneSourceSize(ctx context.Context, sourceID, dcslug string) (int64, error) {
+	if sourceID == "" {
+		return 0, status.Error(codes.InvalidArgument, "CreateVolume volume source ID is missing")
+	}
+
+	source, err := c.Driver.storage.GetVolume(ctx, sourceID)
+	if err != nil {
+		return 0, uthoStatus(err, "cannot get source volume "+sourceID)
+	}
+
+	if !c.Driver.canManageVolume(*source) {
+		return 0, status.Errorf(codes.FailedPrecondition, "cannot clone volume %s, it is not owned by this cluster", sourceID)
+	}
+
+	if source.Location.Dc != "" && !strings.EqualFold(source.Location.Dc, dcslug) {
+		return 0, status.Errorf(codes.InvalidArgument, "cannot clone volume %s from datacenter %s into %s", sourceID, source.Location.Dc, dcslug)
+	}
+
+	size, err := ebsSizeInBytes(source.Size)
+	if err != nil {
+		return 0, status.Errorf(codes.Internal, "invalid size %q for volume %s: %v", source.Size, sourceID, err)
+	}
+
+	return size, nil
+}
+
+// cloneSnapshot returns the internal snapshot used to clone sourceID into volName,
+// taking it first if needed. It is named after the clone so retries find it again
+func (c *UthoControllerServer) cloneSnapshot(ctx context.Context, volName, sourceID string) (string, error) {
+	snapshot, err := c.findCloneSnapshot(ctx, volName, sourceID)
+	if err != nil {
+		return "", err
+	}
+
+	if snapshot == nil {
+		snapshotID, err := c.Driver.storage.CreateSnapshot(ctx, sourceID, cloneSnapshotName(volName))
+		if err != nil {
+			return "", uthoStatus(err, "cannot snapshot source volume "+sourceID)
+		}
+
+		c.Driver.log.WithFields(logrus.Fields{
+			"snapshot-id":      snapshotID,
+			"source-volume-id": sourceID,
+			"volume-name":      volName,
+		}).Info("Create Volume: took clone snapshot")
+
+		if snapshot, err = c.findCloneSnapshot(ctx, volName, sourceID); err != nil {
+			return "", err
+		}
+	}
+
+	// let the provisioner retry until the snapshot can be restored
+	if snapshot == nil || !strings.EqualFold(snapshot.Status, snapshotStatusReady) {
+		return "", status.Errorf(codes.Unavailable, "clone snapshot of volume %s is not ready yet", sourceID)
+	}
+
+	return snapshot.ID, nil
+}
+
+// findCloneSnapshot returns the internal snapshot of sourceID taken to clone volName, if any
+func (c *UthoControllerServer) findCloneSnapshot(ctx context.Context, volName, sourceID string) (*Snapshot, error) {
+	snapshots, err := c.Driver.storage.ListSnapshots(ctx)
+	if err != nil {
+		return nil, uthoStatus(err, "cannot list snapshots")
+	}
+
+	for i := range snapshots {
+		if snapshots[i].Name == cloneSnapshotName(volName) && snapshots[i].EbsID == sourceID {
+			return &snapshots[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// finishClone waits for the clone to be restored and deletes its internal snapshot. The
+// snapshot is kept while the restore may still read from it, the provisioner retries the
+// call until the clone is ready and the snapshot is gone
+func (c *UthoControllerServer) finishClone(ctx context.Context, volName, sourceID, volumeID string) error {
+	if err := c.waitForVolumeReady(ctx, volumeID); err != nil {
+		return err
+	}
+
+	snapshot, err := c.findCloneSnapshot(ctx, volName, sourceID)
+	if err != nil || snapshot == nil {
+		return err
+	}
+
+	if err := c.Driver.storage.DeleteSnapshot(ctx, sourceID, snapshot.ID); err != nil && !isUthoNotFound(err) {
+		return uthoStatus(err, "cannot delete clone snapshot "+snapshot.ID)
+	}
+
+	c.Driver.log.WithFields(logrus.Fields{
+		"snapshot-id": snapshot.ID,
+		"volume-id":   volumeID,
+		"volume-name": volName,
+	}).Info("Create Volume: deleted clone snapshot")
+
+	return nil
+}
+
+// cloneSnapshotPrefix marks the internal snapshots clones are restored from
+const cloneSnapshotPrefix = "clone-"
+
+func cloneSnapshotName(volName string) string {
+	return cloneSnapshotPrefix + volName
+}
+
 // DeleteVolume performs the volume deletion
 func (c *UthoControllerServer) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest) (*csi.DeleteVolumeResponse, error) {
 	if req.VolumeId == "" {
@@ -160,29 +538,48 @@ func (c *UthoControllerServer) DeleteVolume(ctx context.Context, req *csi.Delete
 		"volume-id": req.VolumeId,
 	}).Info("Delete volume: called")
 
-	volumes, err := c.Driver.client.Ebs().List()
+	unlock, err := c.Driver.lock(lockVolumeID, req.VolumeId)
 	if err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
+		return nil, err
+	}
+	defer unlock()
+
+	volumes, err := c.Driver.volumeCache.list(ctx, c.Driver.storage)
+	if err != nil {
+		return nil, uthoStatus(err, "cannot list volumes")
 	}
 
 	// chechk if exist
-	exists := false
-	for _, volume := range volumes {
-		if volume.ID == req.VolumeId {
-			exists = true
+	var existing *Volume
+	for i := range volumes {
+		if volumes[i].ID == req.VolumeId {
+			existing = &volumes[i]
 			break
 		}
 	}
-	if !exists {
+	if existing == nil {
 		c.Driver.log.WithFields(logrus.Fields{
 			"volume-id": req.VolumeId,
 		}).Info("Delete Volume: volume doesn't exist")
 		return &csi.DeleteVolumeResponse{}, nil
 	}
 
-	_, err = c.Driver.client.Ebs().Delete(req.VolumeId)
+	if !c.Driver.canManageVolume(*existing) {
+		return nil, status.Errorf(codes.FailedPrecondition, "cannot delete volume %s, it is not owned by this cluster", req.VolumeId)
+	}
+
+	err = c.Driver.storage.DeleteVolume(ctx, req.VolumeId)
+	c.Driver.volumeCache.invalidate()
 	if err != nil {
-		return nil, status.Errorf(codes.Internal, "cannot delete volume, %v", err.Error())
+		// deleted behind our back since the listing
+		if isUthoNotFound(err) {
+			return &csi.DeleteVolumeResponse{}, nil
+		}
+		// the CO deletes a volume only once it is unpublished, it may still be detaching
+		if isUthoAttached(err) {
+			return nil, status.Errorf(codes.FailedPrecondition, "cannot delete volume %s, it is still attached to a node: %v", req.VolumeId, err)
+		}
+		return nil, uthoStatus(err, "cannot delete volume")
 	}
 
 	c.Driver.log.WithFields(logrus.Fields{
@@ -210,9 +607,19 @@ func (c *UthoControllerServer) ControllerPublishVolume(ctx context.Context, req
 		return nil, status.Error(codes.InvalidArgument, "ControllerPublishVolume read only is not currently supported")
 	}
 
-	volume, err := c.Driver.client.Ebs().Read(req.VolumeId)
+	unlock, err := c.Driver.lock(lockVolumeID, req.VolumeId)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	volume, err := c.Driver.storage.GetVolume(ctx, req.VolumeId)
 	if err != nil {
-		return nil, status.Errorf(codes.NotFound, "cannot get volume: %v", err.Error())
+		return nil, uthoStatus(err, "cannot get volume")
+	}
+
+	if !c.Driver.canManageVolume(*volume) {
+		return nil, status.Errorf(codes.FailedPrecondition, "cannot attach volume %s, it is not owned by this cluster", req.VolumeId)
 	}
 
 	// if _, err = c.Driver.client.CloudInstances().Read(req.NodeId); err != nil {
@@ -221,6 +628,8 @@ func (c *UthoControllerServer) ControllerPublishVolume(ctx context.Context, req
 
 	// node is already attached, do nothing
 	if volume.Cloudid == req.NodeId {
+		c.finishAttachment(req.VolumeId)
+
 		c.Driver.log.WithFields(logrus.Fields{
 			"volume-id": req.VolumeId,
 			"node-id":   req.NodeId,
@@ -233,8 +642,35 @@ func (c *UthoControllerServer) ControllerPublishVolume(ctx context.Context, req
 		}, nil
 	}
 
+	// a previous call timed out while the volume was attaching, attaching again would
+	// fail because it already is, so pick up where that call left off. An attach that
+	// is stuck for too long is requested again in case Utho dropped it
+	pending, ok := c.pendingAttachment(req.VolumeId)
+	if ok && pending.nodeID != detachedCloudID && isDetached(volume.Cloudid) && time.Since(pending.since) < volumeAttachingStuckTimeout {
+		if pending.nodeID != req.NodeId {
+			return nil, status.Errorf(codes.FailedPrecondition,
+				"cannot attach volume to node because it is being attached to a different node ID: %v node name: %v", pending.nodeID, volume.Name)
+		}
+
+		c.Driver.log.WithFields(logrus.Fields{
+			"volume-id": req.VolumeId,
+			"node-id":   req.NodeId,
+		}).Info("Controller Publish Volume: volume is already attaching, waiting for it")
+
+		if err := c.waitForVolumeState(ctx, req.VolumeId, req.NodeId); err != nil {
+			return nil, err
+		}
+		c.finishAttachment(req.VolumeId)
+
+		return &csi.ControllerPublishVolumeResponse{
+			PublishContext: map[string]string{
+				c.Driver.publishVolumeID: volume.ID,
+			},
+		}, nil
+	}
+
 	// assuming its attached & to the wrong node
-	if volume.Cloudid != "0" {
+	if !isDetached(volume.Cloudid) {
 		return nil, status.Errorf(codes.FailedPrecondition,
 			"cannot attach volume to node because it is already attached to a different node ID: %v node name: %v", volume.Cloudid, volume.Name)
 	}
@@ -244,33 +680,18 @@ func (c *UthoControllerServer) ControllerPublishVolume(ctx context.Context, req
 		"node-id":   req.NodeId,
 	}).Info("Controller Publish Volume: called")
 
-	params := utho.AttachEBSParams{
-		EBSId:      req.VolumeId,
-		ResourceId: req.NodeId,
-		Type:       "cloud",
-	}
-	_, err = c.Driver.client.Ebs().Attach(params)
+	c.startAttachment(req.VolumeId, req.NodeId)
+	err = c.Driver.storage.AttachVolume(ctx, req.VolumeId, req.NodeId)
+	c.Driver.volumeCache.invalidate()
 	if err != nil {
-		return nil, status.Errorf(codes.Internal, "cannot attach volume, %v", err.Error())
+		c.finishAttachment(req.VolumeId)
+		return nil, uthoStatus(err, "cannot attach volume")
 	}
 
-	// attachReady := false
-	// for i := 0; i < volumeStatusCheckRetries; i++ {
-	// 	time.Sleep(volumeStatusCheckInterval * time.Second)
-	// 	bs, _, err := c.Driver.client.BlockStorage.Get(ctx, volume.ID) //nolint:bodyclose
-	// 	if err != nil {
-	// 		return nil, status.Error(codes.Internal, err.Error())
-	// 	}
-
-	// 	if bs.AttachedToInstance == req.NodeId {
-	// 		attachReady = true
-	// 		break
-	// 	}
-	// }
-
-	// if !attachReady {
-	// 	return nil, status.Errorf(codes.Internal, "volume is not attached to node after %v seconds", volumeStatusCheckRetries)
-	// }
+	if err := c.waitForVolumeState(ctx, req.VolumeId, req.NodeId); err != nil {
+		return nil, err
+	}
+	c.finishAttachment(req.VolumeId)
 
 	c.Driver.log.WithFields(logrus.Fields{
 		"volume-id": req.VolumeId,
@@ -299,13 +720,27 @@ func (c *UthoControllerServer) ControllerUnpublishVolume(ctx context.Context, re
 		"node-id":   req.NodeId,
 	}).Info("Controller Publish Unpublish: called")
 
-	volume, err := c.Driver.client.Ebs().Read(req.VolumeId)
+	unlock, err := c.Driver.lock(lockVolumeID, req.VolumeId)
 	if err != nil {
-		return &csi.ControllerUnpublishVolumeResponse{}, nil
+		return nil, err
+	}
+	defer unlock()
+
+	volume, err := c.Driver.storage.GetVolume(ctx, req.VolumeId)
+	if err != nil {
+		// a deleted volume is detached from every node
+		if isUthoNotFound(err) {
+			return &csi.ControllerUnpublishVolumeResponse{}, nil
+		}
+		return nil, uthoStatus(err, "cannot get volume")
 	}
 
-	// node is already unattached, do nothing
-	if volume.Cloudid == "" {
+	// volume is already unattached from this node, do nothing
+	if isDetached(volume.Cloudid) || volume.Cloudid != req.NodeId {
+		if pending, ok := c.pendingAttachment(req.VolumeId); ok && pending.nodeID == detachedCloudID {
+			c.finishAttachment(req.VolumeId)
+		}
+
 		c.Driver.log.WithFields(logrus.Fields{
 			"volume-id": req.VolumeId,
 			"node-id":   req.NodeId,
@@ -314,27 +749,48 @@ func (c *UthoControllerServer) ControllerUnpublishVolume(ctx context.Context, re
 		return &csi.ControllerUnpublishVolumeResponse{}, nil
 	}
 
+	if !c.Driver.canManageVolume(*volume) {
+		return nil, status.Errorf(codes.FailedPrecondition, "cannot detach volume %s, it is not owned by this cluster", req.VolumeId)
+	}
+
 	// if _, err = c.Driver.client.CloudInstances().Read(req.NodeId); err != nil {
 	// 	return nil, status.Errorf(codes.NotFound, "cannot get node: %v", err.Error())
 	// }
 
-	params := utho.AttachEBSParams{
-		EBSId:      req.VolumeId,
-		ResourceId: req.NodeId,
-		Type:       "cloud",
+	// a previous call timed out while the volume was detaching, wait for it instead of detaching again
+	if pending, ok := c.pendingAttachment(req.VolumeId); ok && pending.nodeID == detachedCloudID {
+		c.Driver.log.WithFields(logrus.Fields{
+			"volume-id": req.VolumeId,
+			"node-id":   req.NodeId,
+		}).Info("Controller Publish Unpublish: volume is already detaching, waiting for it")
+
+		if err := c.waitForVolumeState(ctx, req.VolumeId, detachedCloudID); err != nil {
+			return nil, err
+		}
+		c.finishAttachment(req.VolumeId)
+
+		return &csi.ControllerUnpublishVolumeResponse{}, nil
 	}
 
 	c.Driver.log.WithFields(logrus.Fields{
 		"volume-id": req.VolumeId,
 		"node-id":   req.NodeId,
 	}).Info("Controller Publish Unpublish: dettach volume")
-	_, err = c.Driver.client.Ebs().Dettach(params)
+	c.startAttachment(req.VolumeId, detachedCloudID)
+	err = c.Driver.storage.DetachVolume(ctx, req.VolumeId, req.NodeId)
+	c.Driver.volumeCache.invalidate()
 	if err != nil {
-		if strings.Contains(err.Error(), "Block storage volume is not currently attached to a server") {
+		c.finishAttachment(req.VolumeId)
+		if isUthoNotAttached(err) || isUthoNotFound(err) {
 			return &csi.ControllerUnpublishVolumeResponse{}, nil
 		}
-		return nil, status.Errorf(codes.Internal, "cannot detach volume: %v", err.Error())
+		return nil, uthoStatus(err, "cannot detach volume")
+	}
+
+	if err := c.waitForVolumeState(ctx, req.VolumeId, detachedCloudID); err != nil {
+		return nil, err
 	}
+	c.finishAttachment(req.VolumeId)
 
 	c.Driver.log.WithFields(logrus.Fields{
 		"volume-id": req.VolumeId,
@@ -344,55 +800,236 @@ func (c *UthoControllerServer) ControllerUnpublishVolume(ctx context.Context, re
 	return &csi.ControllerUnpublishVolumeResponse{}, nil
 }
 
-// ValidateVolumeCapabilities checks if requested capabilities are supported
-func (c *UthoControllerServer) ValidateVolumeCapabilities(ctx context.Context, req *csi.ValidateVolumeCapabilitiesRequest) (*csi.ValidateVolumeCapabilitiesResponse, error) { //nolint:lll
-	if req.VolumeId == "" {
-		return nil, status.Error(codes.InvalidArgument, "ValidateVolumeCapabilities Volume ID is missing")
-	}
+// startAttachment records that an attach to nodeID, or a detach, was requested for the volume
+func (c *UthoControllerServer) startAttachment(volumeID, nodeID string) {
+	c.attachmentsMu.Lock()
+	defer c.attachmentsMu.Unlock()
 
-	if req.VolumeCapabilities == nil {
-		return nil, status.Error(codes.InvalidArgument, "ValidateVolumeCapabilities Volume Capabilities is missing")
-	}
+	c.attachments[volumeID] = attachment{nodeID: nodeID, since: time.Now()}
+}
 
-	if _, err := c.Driver.client.Ebs().Read(req.VolumeId); err != nil {
-		return nil, status.Errorf(codes.NotFound, "cannot get volume: %v", err.Error())
-	}
+// finishAttachment forgets the attach or detach of the volume once Utho completed or refused it
+func (c *UthoControllerServer) finishAttachment(volumeID string) {
+	c.attachmentsMu.Lock()
+	defer c.attachmentsMu.Unlock()
 
-	res := &csi.ValidateVolumeCapabilitiesResponse{
-		Confirmed: &csi.ValidateVolumeCapabilitiesResponse_Confirmed{
-			VolumeCapabilities: []*csi.VolumeCapability{
-				{
-					AccessMode: supportedVolCapabilities,
-				},
-			},
-		},
-	}
+	delete(c.attachments, volumeID)
+}
 
-	c.Driver.log.WithFields(logrus.Fields{
-		"response": res,
-		"method":   "validate-volume-capabilities",
-	})
+// pendingAttachment returns the attach or detach of the volume that hasn't completed yet, if any
+func (c *UthoControllerServer) pendingAttachment(volumeID string) (attachment, bool) {
+	c.attachmentsMu.Lock()
+	defer c.attachmentsMu.Unlock()
 
-	return res, nil
+	pending, ok := c.attachments[volumeID]
+	return pending, ok
 }
 
-// ListVolumes performs the list volume function
-func (c *UthoControllerServer) ListVolumes(ctx context.Context, req *csi.ListVolumesRequest) (*csi.ListVolumesResponse, error) {
-	if req.StartingToken != "" {
-		_, err := strconv.Atoi(req.StartingToken)
-		if err != nil {
-			return nil, status.Errorf(codes.Aborted, "ListVolumes starting_token is invalid: %s", err)
+// waitForVolumeState polls the volume until it is attached to cloudID, or detached
+// when cloudID is detachedCloudID
+func (c *UthoControllerServer) waitForVolumeState(ctx context.Context, volumeID, cloudID string) error {
+	var current string
+	err := c.pollVolume(ctx, volumeID, func(volume *Volume) (bool, error) {
+		current = volume.Cloudid
+		if cloudID == detachedCloudID {
+			return isDetached(current), nil
+		}
+
+		if current == cloudID {
+			return true, nil
+		}
+
+		// somebody else attached the volume while we were waiting
+		if !isDetached(current) {
+			return false, status.Errorf(codes.Aborted, "volume %s was attached to node %s while waiting for node %s", volumeID, current, cloudID)
 		}
+
+		return false, nil
+	})
+
+	if isPollTimeout(err) {
+		return status.Errorf(codes.DeadlineExceeded, "timed out waiting for volume %s to reach node %q, currently on %q", volumeID, cloudID, current)
 	}
+	return err
+}
 
-	var entries []*csi.ListVolumesResponse_Entry
-	c.Driver.log.WithFields(logrus.Fields{}).Info("List Volumes: calling list volume")
-	volumes, err := c.Driver.client.Ebs().List()
-	if err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
+// waitForVolumeReady polls the volume until Utho is done creating or restoring it
+func (c *UthoControllerServer) waitForVolumeReady(ctx context.Context, volumeID string) error {
+	var current string
+	err := c.pollVolume(ctx, volumeID, func(volume *Volume) (bool, error) {
+		current = volume.Status
+		return !containsAny(strings.ToLower(current), volumeStatusesInProgress), nil
+	})
+
+	if isPollTimeout(err) {
+		return status.Errorf(codes.DeadlineExceeded, "timed out waiting for volume %s to be ready, currently %q", volumeID, current)
 	}
+	return err
+}
 
-	for _, volume := range volumes {
+// pollVolume polls the volume with exponential backoff until done reports true. The wait
+// is bounded by the request deadline, or defaultTimeout when the request has none
+func (c *UthoControllerServer) pollVolume(ctx context.Context, volumeID string, done func(*Volume) (bool, error)) error {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, defaultTimeout)
+		defer cancel()
+	}
+
+	log := c.Driver.log.WithFields(logrus.Fields{
+		"volume-id": volumeID,
+	})
+
+	backoff := wait.Backoff{
+		Duration: volumeStatusCheckInterval,
+		Factor:   2,
+		Jitter:   0.1,
+		Steps:    math.MaxInt32,
+		Cap:      volumeStatusCheckMaxInterval,
+	}
+
+	err := wait.ExponentialBackoffWithContext(ctx, backoff, func(context.Context) (bool, error) {
+		volume, err := c.Driver.storage.GetVolume(ctx, volumeID)
+		if err != nil {
+			// polling again won't fix bad credentials or bring back a deleted volume
+			if kind := classifyUthoError(err); kind == uthoErrAuth || kind == uthoErrNotFound {
+				return false, uthoStatus(err, "cannot get volume")
+			}
+
+			// keep polling, the API may just be slow to catch up
+			log.Warnf("cannot get volume while waiting for it: %v", err)
+			return false, nil
+		}
+
+		return done(volume)
+	})
+
+	if errors.Is(err, context.Canceled) {
+		return status.Errorf(codes.Aborted, "waiting for volume %s was cancelled", volumeID)
+	}
+	return err
+}
+
+// isPollTimeout reports whether polling gave up because the request ran out of time
+func isPollTimeout(err error) bool {
+	return wait.Interrupted(err) && !errors.Is(err, context.Canceled)
+}
+
+// publishedNodeIDs returns the node the volume is attached to, if any
+func publishedNodeIDs(volume utho.Ebs) []string {
+	if isDetached(volume.Cloudid) {
+		return nil
+	}
+
+	return []string{volume.Cloudid}
+}
+
+// volumeCondition reports the health of the volume from its Utho status and the
+// attach requested for it, or nil when neither says anything
+func (c *UthoControllerServer) volumeCondition(volume utho.Ebs) *csi.VolumeCondition {
+	if pending, ok := c.pendingAttachment(volume.ID); ok && pending.nodeID != detachedCloudID && volume.Cloudid != pending.nodeID {
+		if stuck := time.Since(pending.since); stuck > volumeAttachingStuckTimeout {
+			return &csi.VolumeCondition{
+				Abnormal: true,
+				Message:  fmt.Sprintf("volume has been attaching to node %s for %v", pending.nodeID, stuck.Round(time.Second)),
+			}
+		}
+
+		return &csi.VolumeCondition{
+			Abnormal: false,
+			Message:  fmt.Sprintf("volume is attaching to node %s", pending.nodeID),
+		}
+	}
+
+	switch strings.ToLower(volume.Status) {
+	case "":
+		return nil
+	case "error", "failed":
+		return &csi.VolumeCondition{
+			Abnormal: true,
+			Message:  fmt.Sprintf("volume is in %q state on Utho", volume.Status),
+		}
+	case "deleting", "deleted":
+		return &csi.VolumeCondition{
+			Abnormal: true,
+			Message:  fmt.Sprintf("volume is being deleted on Utho (%q)", volume.Status),
+		}
+	default:
+		return &csi.VolumeCondition{
+			Abnormal: false,
+			Message:  fmt.Sprintf("volume is %q", volume.Status),
+		}
+	}
+}
+
+// isDetached reports whether the cloudid of a volume means it isn't attached anywhere
+func isDetached(cloudID string) bool {
+	return cloudID == "" || cloudID == detachedCloudID
+}
+
+// ValidateVolumeCapabilities checks if requested capabilities are supported
+func (c *UthoControllerServer) ValidateVolumeCapabilities(ctx context.Context, req *csi.ValidateVolumeCapabilitiesRequest) (*csi.ValidateVolumeCapabilitiesResponse, error) { //nolint:lll
+	if req.VolumeId == "" {
+		return nil, status.Error(codes.InvalidArgument, "ValidateVolumeCapabilities Volume ID is missing")
+	}
+
+	if req.VolumeCapabilities == nil {
+		return nil, status.Error(codes.InvalidArgument, "ValidateVolumeCapabilities Volume Capabilities is missing")
+	}
+
+	if _, err := c.Driver.storage.GetVolume(ctx, req.VolumeId); err != nil {
+		return nil, uthoStatus(err, "cannot get volume")
+	}
+
+	res := &csi.ValidateVolumeCapabilitiesResponse{
+		Confirmed: &csi.ValidateVolumeCapabilitiesResponse_Confirmed{
+			VolumeCapabilities: []*csi.VolumeCapability{
+				{
+					AccessMode: supportedVolCapabilities,
+				},
+			},
+		},
+	}
+
+	c.Driver.log.WithFields(logrus.Fields{
+		"response": res,
+		"method":   "validate-volume-capabilities",
+	})
+
+	return res, nil
+}
+
+// ListVolumes performs the list volume function
+func (c *UthoControllerServer) ListVolumes(ctx context.Context, req *csi.ListVolumesRequest) (*csi.ListVolumesResponse, error) {
+	c.Driver.log.WithFields(logrus.Fields{
+		"starting-token": req.StartingToken,
+		"max-entries":    req.MaxEntries,
+	}).Info("List Volumes: calling list volume")
+
+	allVolumes, err := c.Driver.volumeCache.list(ctx, c.Driver.storage)
+	if err != nil {
+		return nil, uthoStatus(err, "cannot list volumes")
+	}
+
+	var volumes []Volume
+	for _, volume := range allVolumes {
+		if c.Driver.ownsVolume(volume) {
+			volumes = append(volumes, volume)
+		}
+	}
+
+	// the API gives no ordering guarantee, sort so tokens stay valid between calls
+	sort.Slice(volumes, func(i, j int) bool {
+		return volumes[i].ID < volumes[j].ID
+	})
+
+	start, end, nextToken, err := paginate(len(volumes), req.StartingToken, req.MaxEntries)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []*csi.ListVolumesResponse_Entry
+	for _, volume := range volumes[start:end] {
 		byteSize, err := strconv.ParseFloat(volume.Size, 64)
 		if err != nil {
 			return nil, status.Error(codes.Internal, err.Error())
@@ -402,20 +1039,502 @@ func (c *UthoControllerServer) ListVolumes(ctx context.Context, req *csi.ListVol
 				VolumeId:      volume.ID,
 				CapacityBytes: int64(byteSize) * giB,
 			},
+			Status: &csi.ListVolumesResponse_VolumeStatus{
+				PublishedNodeIds: publishedNodeIDs(volume.Ebs),
+				VolumeCondition:  c.volumeCondition(volume.Ebs),
+			},
 		})
 	}
 
 	res := &csi.ListVolumesResponse{
-		Entries: entries,
+		Entries:   entries,
+		NextToken: nextToken,
 	}
 
 	c.Driver.log.WithFields(logrus.Fields{
-		"volumes": entries,
+		"volumes":    entries,
+		"next-token": nextToken,
 	}).Info("List Volumes")
 
 	return res, nil
 }
 
+// ControllerGetVolume returns the capacity, published node and condition of a single volume
+func (c *UthoControllerServer) ControllerGetVolume(ctx context.Context, req *csi.ControllerGetVolumeRequest) (*csi.ControllerGetVolumeResponse, error) { //nolint:lll
+	if req.VolumeId == "" {
+		return nil, status.Error(codes.InvalidArgument, "ControllerGetVolume Volume ID is missing")
+	}
+
+	c.Driver.log.WithFields(logrus.Fields{
+		"volume-id": req.VolumeId,
+		"method":    "controller-get-volume",
+	}).Info("Controller Get Volume: called")
+
+	volume, err := c.Driver.storage.GetVolume(ctx, req.VolumeId)
+	if err != nil {
+		return nil, uthoStatus(err, "cannot get volume")
+	}
+
+	size, err := ebsSizeInBytes(volume.Size)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	res := &csi.ControllerGetVolumeResponse{
+		Volume: &csi.Volume{
+			VolumeId:      volume.ID,
+			CapacityBytes: size,
+		},
+		Status: &csi.ControllerGetVolumeResponse_VolumeStatus{
+			PublishedNodeIds: publishedNodeIDs(volume.Ebs),
+			VolumeCondition:  c.volumeCondition(volume.Ebs),
+		},
+	}
+
+	c.Driver.log.WithFields(logrus.Fields{
+		"response": res,
+		"method":   "controller-get-volume",
+	}).Info("Controller Get Volume")
+
+	return res, nil
+}
+
+// ControllerExpandVolume grows the volume on the Utho side, the filesystem is resized by NodeExpandVolume
+func (c *UthoControllerServer) ControllerExpandVolume(ctx context.Context, req *csi.ControllerExpandVolumeRequest) (*csi.ControllerExpandVolumeResponse, error) { //nolint:lll
+	if req.VolumeId == "" {
+		return nil, status.Error(codes.InvalidArgument, "ControllerExpandVolume Volume ID is missing")
+	}
+
+	if req.CapacityRange == nil {
+		return nil, status.Error(codes.InvalidArgument, "ControllerExpandVolume Capacity Range is missing")
+	}
+
+	size, err := extractStorage(req.CapacityRange)
+	if err != nil {
+		return nil, status.Errorf(codes.OutOfRange, "invalid capacity range: %v", err)
+	}
+
+	log := c.Driver.log.WithFields(logrus.Fields{
+		"volume-id": req.VolumeId,
+		"size":      size,
+		"method":    "controller-expand-volume",
+	})
+	log.Info("Controller Expand Volume: called")
+
+	unlock, err := c.Driver.lock(lockVolumeID, req.VolumeId)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	volume, err := c.Driver.storage.GetVolume(ctx, req.VolumeId)
+	if err != nil {
+		return nil, uthoStatus(err, "cannot get volume")
+	}
+
+	if !c.Driver.canManageVolume(*volume) {
+		return nil, status.Errorf(codes.FailedPrecondition, "cannot expand volume %s, it is not owned by this cluster", req.VolumeId)
+	}
+
+	currentSize, err := ebsSizeInBytes(volume.Size)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	// block volumes have no filesystem to grow on the node
+	nodeExpansionRequired := req.VolumeCapability == nil || req.VolumeCapability.GetBlock() == nil
+
+	// volume is already big enough, do nothing
+	if currentSize >= size {
+		if limit := req.CapacityRange.GetLimitBytes(); limit > 0 && currentSize > limit {
+			return nil, status.Errorf(codes.OutOfRange, "cannot shrink volume from %v to %v", formatBytes(currentSize), formatBytes(limit))
+		}
+
+		log.Info("Controller Expand Volume: volume is already at the requested size, do nothing")
+
+		return &csi.ControllerExpandVolumeResponse{
+			CapacityBytes:         currentSize,
+			NodeExpansionRequired: nodeExpansionRequired,
+		}, nil
+	}
+
+	sizeGB, err := volumeSizeGB(size, req.CapacityRange)
+	if err != nil {
+		return nil, err
+	}
+
+	// the API sets the performance along with the size, keep it as it is
+	err = c.Driver.storage.ResizeVolume(ctx, req.VolumeId, ResizeVolumeParams{
+		Disk:       strconv.Itoa(sizeGB),
+		Iops:       volume.Iops,
+		Throughput: volume.Throughput,
+	})
+	c.Driver.volumeCache.invalidate()
+	if err != nil {
+		return nil, uthoStatus(err, "cannot resize volume")
+	}
+
+	log.WithFields(logrus.Fields{
+		"new-size": int64(sizeGB) * giB,
+	}).Info("Controller Expand Volume: volume resized")
+
+	return &csi.ControllerExpandVolumeResponse{
+		CapacityBytes:         int64(sizeGB) * giB,
+		NodeExpansionRequired: nodeExpansionRequired,
+	}, nil
+}
+
+// CreateSnapshot takes a snapshot of the source volume, repeated calls with the same name return the existing snapshot
+func (c *UthoControllerServer) CreateSnapshot(ctx context.Context, req *csi.CreateSnapshotRequest) (*csi.CreateSnapshotResponse, error) {
+	if req.Name == "" {
+		return nil, status.Error(codes.InvalidArgument, "CreateSnapshot Name is missing")
+	}
+
+	if req.SourceVolumeId == "" {
+		return nil, status.Error(codes.InvalidArgument, "CreateSnapshot Source Volume ID is missing")
+	}
+
+	log := c.Driver.log.WithFields(logrus.Fields{
+		"snapshot-name":    req.Name,
+		"source-volume-id": req.SourceVolumeId,
+		"method":           "create-snapshot",
+	})
+	log.Info("Create Snapshot: called")
+
+	unlock, err := c.Driver.lock(lockSnapshotName, req.Name)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	// check that the snapshot doesn't already exist
+	snapshots, err := c.Driver.storage.ListSnapshots(ctx)
+	if err != nil {
+		return nil, uthoStatus(err, "cannot list snapshots")
+	}
+
+	for _, snapshot := range snapshots {
+		if snapshot.Name != req.Name {
+			continue
+		}
+
+		if snapshot.EbsID != req.SourceVolumeId {
+			return nil, status.Errorf(codes.AlreadyExists, "snapshot with the same name %q but different source volume %q already exists", req.Name, snapshot.EbsID)
+		}
+
+		csiSnapshot, err := toCSISnapshot(snapshot)
+		if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+
+		log.Info("Create Snapshot: snapshot already exists")
+		return &csi.CreateSnapshotResponse{Snapshot: csiSnapshot}, nil
+	}
+
+	volume, err := c.Driver.storage.GetVolume(ctx, req.SourceVolumeId)
+	if err != nil {
+		return nil, uthoStatus(err, "cannot get source volume")
+	}
+
+	if !c.Driver.canManageVolume(*volume) {
+		return nil, status.Errorf(codes.FailedPrecondition, "cannot snapshot volume %s, it is not owned by this cluster", req.SourceVolumeId)
+	}
+
+	snapshotID, err := c.Driver.storage.CreateSnapshot(ctx, req.SourceVolumeId, req.Name)
+	if err != nil {
+		return nil, uthoStatus(err, "cannot create snapshot")
+	}
+
+	// read the snapshot back so the creation time and state come from Utho
+	snapshots, err = c.Driver.storage.ListSnapshots(ctx)
+	if err != nil {
+		return nil, uthoStatus(err, "cannot list snapshots")
+	}
+
+	for _, snapshot := range snapshots {
+		if snapshot.ID == snapshotID {
+			csiSnapshot, err := toCSISnapshot(snapshot)
+			if err != nil {
+				return nil, status.Error(codes.Internal, err.Error())
+			}
+
+			log.WithField("snapshot-id", snapshotID).Info("Create Snapshot: created snapshot")
+			return &csi.CreateSnapshotResponse{Snapshot: csiSnapshot}, nil
+		}
+	}
+
+	// the snapshot is not listed yet, report it as not ready so the snapshotter polls again
+	size, err := ebsSizeInBytes(volume.Size)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	log.WithField("snapshot-id", snapshotID).Info("Create Snapshot: created snapshot")
+
+	return &csi.CreateSnapshotResponse{
+		Snapshot: &csi.Snapshot{
+			SnapshotId:     snapshotID,
+			SourceVolumeId: req.SourceVolumeId,
+			SizeBytes:      size,
+			CreationTime:   timestamppb.Now(),
+			ReadyToUse:     false,
+		},
+	}, nil
+}
+
+// DeleteSnapshot removes the snapshot, deleting a snapshot that doesn't exist succeeds
+func (c *UthoControllerServer) DeleteSnapshot(ctx context.Context, req *csi.DeleteSnapshotRequest) (*csi.DeleteSnapshotResponse, error) {
+	if req.SnapshotId == "" {
+		return nil, status.Error(codes.InvalidArgument, "DeleteSnapshot Snapshot ID is missing")
+	}
+
+	log := c.Driver.log.WithFields(logrus.Fields{
+		"snapshot-id": req.SnapshotId,
+		"method":      "delete-snapshot",
+	})
+	log.Info("Delete Snapshot: called")
+
+	unlock, err := c.Driver.lock(lockSnapshotID, req.SnapshotId)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	snapshots, err := c.Driver.storage.ListSnapshots(ctx)
+	if err != nil {
+		return nil, uthoStatus(err, "cannot list snapshots")
+	}
+
+	// the snapshot is deleted through the volume it was taken of
+	var volumeID string
+	for _, snapshot := range snapshots {
+		if snapshot.ID == req.SnapshotId {
+			volumeID = snapshot.EbsID
+			break
+		}
+	}
+	if volumeID == "" {
+		log.Info("Delete Snapshot: snapshot doesn't exist")
+		return &csi.DeleteSnapshotResponse{}, nil
+	}
+
+	if err := c.Driver.storage.DeleteSnapshot(ctx, volumeID, req.SnapshotId); err != nil {
+		if isUthoNotFound(err) {
+			log.Info("Delete Snapshot: snapshot doesn't exist")
+			return &csi.DeleteSnapshotResponse{}, nil
+		}
+		return nil, uthoStatus(err, "cannot delete snapshot")
+	}
+
+	log.Info("Delete Snapshot: deleted")
+
+	return &csi.DeleteSnapshotResponse{}, nil
+}
+
+// ListSnapshots lists snapshots, optionally filtered by snapshot or source volume ID
+func (c *UthoControllerServer) ListSnapshots(ctx context.Context, req *csi.ListSnapshotsRequest) (*csi.ListSnapshotsResponse, error) {
+	log := c.Driver.log.WithFields(logrus.Fields{
+		"snapshot-id":      req.SnapshotId,
+		"source-volume-id": req.SourceVolumeId,
+		"starting-token":   req.StartingToken,
+		"max-entries":      req.MaxEntries,
+		"method":           "list-snapshots",
+	})
+	log.Info("List Snapshots: called")
+
+	snapshots, err := c.Driver.storage.ListSnapshots(ctx)
+	if err != nil {
+		return nil, uthoStatus(err, "cannot list snapshots")
+	}
+
+	var filtered []Snapshot
+	for _, snapshot := range snapshots {
+		// the snapshots taken to clone volumes are the driver's own, the CO never created them
+		if strings.HasPrefix(snapshot.Name, cloneSnapshotPrefix) {
+			continue
+		}
+		if req.SnapshotId != "" && snapshot.ID != req.SnapshotId {
+			continue
+		}
+		if req.SourceVolumeId != "" && snapshot.EbsID != req.SourceVolumeId {
+			continue
+		}
+		filtered = append(filtered, snapshot)
+	}
+
+	// the API gives no ordering guarantee, sort so tokens stay valid between calls
+	sort.Slice(filtered, func(i, j int) bool {
+		return filtered[i].ID < filtered[j].ID
+	})
+
+	start, end, nextToken, err := paginate(len(filtered), req.StartingToken, req.MaxEntries)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []*csi.ListSnapshotsResponse_Entry
+	for _, snapshot := range filtered[start:end] {
+		csiSnapshot, err := toCSISnapshot(snapshot)
+		if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+
+		entries = append(entries, &csi.ListSnapshotsResponse_Entry{
+			Snapshot: csiSnapshot,
+		})
+	}
+
+	log.WithField("snapshots", len(entries)).Info("List Snapshots")
+
+	return &csi.ListSnapshotsResponse{
+		Entries:   entries,
+		NextToken: nextToken,
+	}, nil
+}
+
+// GetCapacity returns the block storage still available to the account in the requested datacenter
+func (c *UthoControllerServer) GetCapacity(ctx context.Context, req *csi.GetCapacityRequest) (*csi.GetCapacityResponse, error) {
+	dcslug := c.Driver.dcslug
+	if region := req.GetAccessibleTopology().GetSegments()[topologyRegionKey]; region != "" {
+		dcslug = region
+	}
+
+	log := c.Driver.log.WithFields(logrus.Fields{
+		"dcslug": dcslug,
+		"method": "get-capacity",
+	})
+	log.Info("Get Capacity: called")
+
+	// no capacity for volumes we can't provision anyway
+	if len(req.VolumeCapabilities) > 0 && !isValidCapability(req.VolumeCapabilities) {
+		log.Info("Get Capacity: volume capabilities are not supported")
+		return &csi.GetCapacityResponse{}, nil
+	}
+
+	quotas, err := c.Driver.storage.ListQuotas(ctx)
+	if err != nil {
+		// the account may not have the quota API, leave capacity unreported
+		if isUthoNotFound(err) {
+			return nil, status.Errorf(codes.Unimplemented, "block storage quota is not available: %v", err)
+		}
+		return nil, uthoStatus(err, "cannot get block storage quota")
+	}
+
+	var available int64
+	found := false
+	for _, quota := range quotas {
+		if !strings.EqualFold(quota.Dcslug, dcslug) {
+			continue
+		}
+
+		limit, err := ebsSizeInBytes(quota.Limit)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "invalid quota limit %q for %s: %v", quota.Limit, dcslug, err)
+		}
+		used, err := ebsSizeInBytes(quota.Used)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "invalid quota usage %q for %s: %v", quota.Used, dcslug, err)
+		}
+
+		available = limit - used
+		if available < 0 {
+			available = 0
+		}
+		found = true
+		break
+	}
+	// no quota doesn't mean no room, leave capacity unreported rather than claim there is none
+	if !found {
+		log.Info("Get Capacity: no block storage quota for datacenter")
+		return nil, status.Errorf(codes.Unimplemented, "no block storage quota is reported for datacenter %s", dcslug)
+	}
+
+	maximumVolumeSize := maximumVolumeSizeInBytes
+	if available < maximumVolumeSize {
+		maximumVolumeSize = available
+	}
+
+	res := &csi.GetCapacityResponse{
+		AvailableCapacity: available,
+		MaximumVolumeSize: wrapperspb.Int64(maximumVolumeSize),
+		MinimumVolumeSize: wrapperspb.Int64(minimumVolumeSizeInBytes),
+	}
+
+	log.WithFields(logrus.Fields{
+		"available":           available,
+		"maximum-volume-size": maximumVolumeSize,
+	}).Info("Get Capacity")
+
+	return res, nil
+}
+
+// ControllerModifyVolume changes the iops and throughput of a volume from its VolumeAttributesClass
+func (c *UthoControllerServer) ControllerModifyVolume(ctx context.Context, req *csi.ControllerModifyVolumeRequest) (*csi.ControllerModifyVolumeResponse, error) { //nolint:lll
+	if req.VolumeId == "" {
+		return nil, status.Error(codes.InvalidArgument, "ControllerModifyVolume Volume ID is missing")
+	}
+
+	log := c.Driver.log.WithFields(logrus.Fields{
+		"volume-id":          req.VolumeId,
+		"mutable-parameters": req.MutableParameters,
+		"method":             "controller-modify-volume",
+	})
+	log.Info("Controller Modify Volume: called")
+
+	unlock, err := c.Driver.lock(lockVolumeID, req.VolumeId)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	volume, err := c.Driver.storage.GetVolume(ctx, req.VolumeId)
+	if err != nil {
+		return nil, uthoStatus(err, "cannot get volume")
+	}
+
+	if !c.Driver.canManageVolume(*volume) {
+		return nil, status.Errorf(codes.FailedPrecondition, "cannot modify volume %s, it is not owned by this cluster", req.VolumeId)
+	}
+
+	volParams, err := parseMutableParameters(req.MutableParameters)
+	if err != nil {
+		return nil, err
+	}
+
+	if volParams.iops == 0 && volParams.throughput == 0 {
+		log.Info("Controller Modify Volume: nothing to modify")
+		return &csi.ControllerModifyVolumeResponse{}, nil
+	}
+
+	size, err := ebsSizeInBytes(volume.Size)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	// Utho changes the performance of a volume through a resize to its current size
+	params := ResizeVolumeParams{
+		Disk:       strconv.FormatInt(size/giB, 10),
+		Iops:       volume.Iops,
+		Throughput: volume.Throughput,
+	}
+	if volParams.iops > 0 {
+		params.Iops = strconv.Itoa(volParams.iops)
+	}
+	if volParams.throughput > 0 {
+		params.Throughput = strconv.Itoa(volParams.throughput)
+	}
+
+	err = c.Driver.storage.ResizeVolume(ctx, req.VolumeId, params)
+	c.Driver.volumeCache.invalidate()
+	if err != nil {
+		return nil, uthoStatus(err, "cannot modify volume")
+	}
+
+	log.Info("Controller Modify Volume: volume modified")
+
+	return &csi.ControllerModifyVolumeResponse{}, nil
+}
+
 // ControllerGetCapabilities get capabilities of the controller
 func (c *UthoControllerServer) ControllerGetCapabilities(context.Context, *csi.ControllerGetCapabilitiesRequest) (*csi.ControllerGetCapabilitiesResponse, error) { //nolint:lll
 	capability := func(capability csi.ControllerServiceCapability_RPC_Type) *csi.ControllerServiceCapability {
@@ -433,8 +1552,15 @@ func (c *UthoControllerServer) ControllerGetCapabilities(context.Context, *csi.C
 		csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
 		csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME,
 		csi.ControllerServiceCapability_RPC_LIST_VOLUMES,
-		// csi.ControllerServiceCapability_RPC_EXPAND_VOLUME,
+		csi.ControllerServiceCapability_RPC_EXPAND_VOLUME,
 		csi.ControllerServiceCapability_RPC_LIST_VOLUMES_PUBLISHED_NODES,
+		csi.ControllerServiceCapability_RPC_VOLUME_CONDITION,
+		csi.ControllerServiceCapability_RPC_GET_VOLUME,
+		csi.ControllerServiceCapability_RPC_GET_CAPACITY,
+		csi.ControllerServiceCapability_RPC_MODIFY_VOLUME,
+		csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT,
+		csi.ControllerServiceCapability_RPC_LIST_SNAPSHOTS,
+		csi.ControllerServiceCapability_RPC_CLONE_VOLUME,
 	} {
 		capabilities = append(capabilities, capability(caps))
 	}
@@ -556,8 +1682,78 @@ func extractStorage(capRange *csi.CapacityRange) (int64, error) {
 	return defaultVolumeSizeInBytes, nil
 }
 
-func bytesToGB(bytes int64) int {
-	const bytesInGB = 1024 * 1024 * 1024
+// volumeSizeGB rounds size up to the whole GB Utho volumes are sized in, so a volume is
+// never smaller than asked for, as long as that stays within the limit of the capacity range
+func volumeSizeGB(size int64, capRange *csi.CapacityRange) (int, error) {
+	sizeGB := int((size + giB - 1) / giB)
+
+	if limit := capRange.GetLimitBytes(); limit > 0 && int64(sizeGB)*giB > limit {
+		return 0, status.Errorf(codes.OutOfRange, "size %v rounded up to whole GB (%dGi) exceeds the capacity limit (%v)",
+			formatBytes(size), sizeGB, formatBytes(limit))
+	}
+
+	return sizeGB, nil
+}
+
+// ebsSizeInBytes converts the GB size string reported by the Utho API to bytes
+func ebsSizeInBytes(size string) (int64, error) {
+	byteSize, err := strconv.ParseFloat(size, 64)
+	if err != nil {
+		return 0, err
+	}
+
+	return int64(byteSize) * giB, nil
+}
+
+// toCSISnapshot converts a Utho EBS snapshot to its CSI representation
+func toCSISnapshot(snapshot Snapshot) (*csi.Snapshot, error) {
+	size, err := ebsSizeInBytes(snapshot.Size)
+	if err != nil {
+		return nil, fmt.Errorf("invalid size %q for snapshot %s: %v", snapshot.Size, snapshot.ID, err)
+	}
+
+	createdAt, err := time.ParseInLocation(uthoTimeLayout, snapshot.CreatedAt, time.UTC)
+	if err != nil {
+		return nil, fmt.Errorf("invalid creation time %q for snapshot %s: %v", snapshot.CreatedAt, snapshot.ID, err)
+	}
+
+	return &csi.Snapshot{
+		SnapshotId:     snapshot.ID,
+		SourceVolumeId: snapshot.EbsID,
+		SizeBytes:      size,
+		CreationTime:   timestamppb.New(createdAt),
+		ReadyToUse:     strings.EqualFold(snapshot.Status, snapshotStatusReady),
+	}, nil
+}
+
+// paginate returns the [start, end) window for a list of total entries along
+// with the token for the next page. Tokens are plain offsets into the sorted list
+func paginate(total int, startingToken string, maxEntries int32) (int, int, string, error) {
+	if maxEntries < 0 {
+		return 0, 0, "", status.Errorf(codes.InvalidArgument, "max_entries (%d) can not be negative", maxEntries)
+	}
+
+	start := 0
+	if startingToken != "" {
+		var err error
+		start, err = strconv.Atoi(startingToken)
+		if err != nil || start < 0 {
+			return 0, 0, "", status.Errorf(codes.Aborted, "starting_token %q is invalid", startingToken)
+		}
+		if start > total {
+			return 0, 0, "", status.Errorf(codes.Aborted, "starting_token %q is past the last entry (%d)", startingToken, total)
+		}
+	}
+
+	end := total
+	if maxEntries > 0 && start+int(maxEntries) < total {
+		end = start + int(maxEntries)
+	}
+
+	nextToken := ""
+	if end < total {
+		nextToken = strconv.Itoa(end)
+	}
 
-	return int(bytes / bytesInGB)
+	return start, end, nextToken, nil
 }
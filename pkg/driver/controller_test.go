@@ -0,0 +1,2073 @@
+package driver_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/uthoplatforms/csi-utho/pkg/driver"
+	"github.com/uthoplatforms/csi-utho/pkg/fake"
+	"github.com/uthoplatforms/utho-go/utho"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	testDcslug = "inmumbaizone2"
+	testNodeID = "node-1"
+	giB        = 1 << 30
+)
+
+func newTestController(t *testing.T, opts ...driver.DriverOption) (*driver.UthoControllerServer, *fake.Cloud) {
+	t.Helper()
+
+	cloud := fake.NewCloud()
+	opts = append([]driver.DriverOption{
+		driver.WithBlockStorage(cloud),
+		driver.WithVolumeCacheTTL(0),
+	}, opts...)
+
+	d, err := driver.NewDriver("unix:///tmp/csi.sock", "", driver.DefaultDriverName, "test", testDcslug, true, opts...)
+	if err != nil {
+		t.Fatalf("cannot create driver: %v", err)
+	}
+
+	return driver.NewUthoControllerServer(d), cloud
+}
+
+func mountCapabilities() []*csi.VolumeCapability {
+	return []*csi.VolumeCapability{
+		{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+		},
+	}
+}
+
+func blockCapability() *csi.VolumeCapability {
+	return &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+	}
+}
+
+func testVolume(id, name, sizeGB, cloudID string) driver.Volume {
+	return driver.Volume{
+		Ebs: utho.Ebs{
+			ID:       id,
+			Name:     name,
+			Size:     sizeGB,
+			Cloudid:  cloudID,
+			Location: utho.Location{Dc: testDcslug},
+		},
+	}
+}
+
+func checkCode(t *testing.T, err error, want codes.Code) {
+	t.Helper()
+
+	if got := status.Code(err); got != want {
+		t.Fatalf("got code %v, want %v (error: %v)", got, want, err)
+	}
+}
+
+func TestCreateVolume(t *testing.T) {
+	unavailable := fake.APIError(http.StatusServiceUnavailable, "Service Unavailable")
+
+	tests := []struct {
+		name  string
+		setup func(*fake.Cloud)
+		req   *csi.CreateVolumeRequest
+		code  codes.Code
+		check func(*testing.T, *csi.CreateVolumeResponse, *fake.Cloud)
+	}{
+		{
+			name: "creates volume with the defaults of the disk type",
+			req:  &csi.CreateVolumeRequest{Name: "pvc-1", VolumeCapabilities: mountCapabilities()},
+			code: codes.OK,
+			check: func(t *testing.T, res *csi.CreateVolumeResponse, cloud *fake.Cloud) {
+				volume, ok := cloud.Volume(res.Volume.VolumeId)
+				if !ok {
+					t.Fatalf("volume %s was not created", res.Volume.VolumeId)
+				}
+				if volume.Size != "16" || cloud.DiskType(volume.ID) != "SSD" || volume.Iops != "3000" || volume.Throughput != "125" {
+					t.Errorf("unexpected volume %+v", volume)
+				}
+				if volume.Cloudid != fake.DetachedCloudID {
+					t.Errorf("new volume has cloudid %q, want %q", volume.Cloudid, fake.DetachedCloudID)
+				}
+				if res.Volume.CapacityBytes != 16*giB {
+					t.Errorf("capacity %d, want %d", res.Volume.CapacityBytes, 16*giB)
+				}
+				if fsType, ok := res.Volume.VolumeContext["fsType"]; ok {
+					t.Errorf("volume context has fsType %q without a StorageClass parameter", fsType)
+				}
+				if region := res.Volume.AccessibleTopology[0].Segments["region"]; region != testDcslug {
+					t.Errorf("topology region %q, want %q", region, testDcslug)
+				}
+			},
+		},
+		{
+			name: "uses the storage class parameters",
+			req: &csi.CreateVolumeRequest{
+				Name:               "pvc-1",
+				VolumeCapabilities: mountCapabilities(),
+				CapacityRange:      &csi.CapacityRange{RequiredBytes: 20 * giB},
+				Parameters:         map[string]string{"type": "nvme", "iops": "5000", "fsType": "xfs"},
+			},
+			code: codes.OK,
+			check: func(t *testing.T, res *csi.CreateVolumeResponse, cloud *fake.Cloud) {
+				volume, _ := cloud.Volume(res.Volume.VolumeId)
+				if volume.Size != "20" || cloud.DiskType(volume.ID) != "NVMe" || volume.Iops != "5000" {
+					t.Errorf("unexpected volume %+v", volume)
+				}
+				if res.Volume.VolumeContext["fsType"] != "xfs" {
+					t.Errorf("volume context %v, want fsType xfs", res.Volume.VolumeContext)
+				}
+			},
+		},
+		{
+			name: "rounds the size up to whole GB",
+			req: &csi.CreateVolumeRequest{
+				Name:               "pvc-1",
+				VolumeCapabilities: mountCapabilities(),
+				CapacityRange:      &csi.CapacityRange{RequiredBytes: 20*giB + 1},
+			},
+			code: codes.OK,
+			check: func(t *testing.T, res *csi.CreateVolumeResponse, cloud *fake.Cloud) {
+				if volume, _ := cloud.Volume(res.Volume.VolumeId); volume.Size != "21" {
+					t.Errorf("volume size %s GB, want 21 GB", volume.Size)
+				}
+				if res.Volume.CapacityBytes != 21*giB {
+					t.Errorf("capacity %d, want %d", res.Volume.CapacityBytes, 21*giB)
+				}
+			},
+		},
+		{
+			name: "refuses to round up past the limit",
+			req: &csi.CreateVolumeRequest{
+				Name:               "pvc-1",
+				VolumeCapabilities: mountCapabilities(),
+				CapacityRange:      &csi.CapacityRange{RequiredBytes: 20*giB + 1, LimitBytes: 20*giB + 512*1024*1024},
+			},
+			code: codes.OutOfRange,
+		},
+		{
+			name: "returns the existing volume with the same name",
+			setup: func(cloud *fake.Cloud) {
+				cloud.AddVolume(testVolume("vol-1", "pvc-1", "16", fake.DetachedCloudID))
+			},
+			req:  &csi.CreateVolumeRequest{Name: "pvc-1", VolumeCapabilities: mountCapabilities()},
+			code: codes.OK,
+			check: func(t *testing.T, res *csi.CreateVolumeResponse, cloud *fake.Cloud) {
+				if res.Volume.VolumeId != "vol-1" {
+					t.Errorf("volume id %s, want vol-1", res.Volume.VolumeId)
+				}
+				if calls := cloud.Calls(fake.OpCreateVolume); calls != 0 {
+					t.Errorf("volume was created %d times, want 0", calls)
+				}
+			},
+		},
+		{
+			name: "rejects an existing volume with the same name and another size",
+			setup: func(cloud *fake.Cloud) {
+				cloud.AddVolume(testVolume("vol-1", "pvc-1", "32", fake.DetachedCloudID))
+			},
+			req:  &csi.CreateVolumeRequest{Name: "pvc-1", VolumeCapabilities: mountCapabilities()},
+			code: codes.AlreadyExists,
+		},
+		{
+			name: "restores from a snapshot",
+			setup: func(cloud *fake.Cloud) {
+				cloud.AddSnapshot(driver.Snapshot{ID: "snap-1", EbsID: "vol-1", Size: "20"})
+			},
+			req: &csi.CreateVolumeRequest{
+				Name:               "pvc-1",
+				VolumeCapabilities: mountCapabilities(),
+				VolumeContentSource: &csi.VolumeContentSource{
+					Type: &csi.VolumeContentSource_Snapshot{Snapshot: &csi.VolumeContentSource_SnapshotSource{SnapshotId: "snap-1"}},
+				},
+			},
+			code: codes.OK,
+			check: func(t *testing.T, res *csi.CreateVolumeResponse, cloud *fake.Cloud) {
+				if res.Volume.CapacityBytes != 20*giB {
+					t.Errorf("capacity %d, want the snapshot size %d", res.Volume.CapacityBytes, 20*giB)
+				}
+				if res.Volume.ContentSource.GetSnapshot().GetSnapshotId() != "snap-1" {
+					t.Errorf("content source %v, want snap-1", res.Volume.ContentSource)
+				}
+			},
+		},
+		{
+			name: "reports a restored volume that can't be read back",
+			setup: func(cloud *fake.Cloud) {
+				cloud.AddSnapshot(driver.Snapshot{ID: "snap-1", EbsID: "vol-1", Size: "20"})
+				cloud.FailOnce(fake.OpGetVolume, fake.APIError(http.StatusNotFound, "Block storage not found"))
+			},
+			req: &csi.CreateVolumeRequest{
+				Name:               "pvc-1",
+				VolumeCapabilities: mountCapabilities(),
+				VolumeContentSource: &csi.VolumeContentSource{
+					Type: &csi.VolumeContentSource_Snapshot{Snapshot: &csi.VolumeContentSource_SnapshotSource{SnapshotId: "snap-1"}},
+				},
+			},
+			code: codes.Aborted,
+		},
+		{
+			name: "waits for a snapshot that is not ready",
+			setup: func(cloud *fake.Cloud) {
+				cloud.AddSnapshot(driver.Snapshot{ID: "snap-1", EbsID: "vol-1", Size: "20", Status: "Pending"})
+			},
+			req: &csi.CreateVolumeRequest{
+				Name:               "pvc-1",
+				VolumeCapabilities: mountCapabilities(),
+				VolumeContentSource: &csi.VolumeContentSource{
+					Type: &csi.VolumeContentSource_Snapshot{Snapshot: &csi.VolumeContentSource_SnapshotSource{SnapshotId: "snap-1"}},
+				},
+			},
+			code: codes.Unavailable,
+		},
+		{
+			name: "rejects a missing snapshot",
+			req: &csi.CreateVolumeRequest{
+				Name:               "pvc-1",
+				VolumeCapabilities: mountCapabilities(),
+				VolumeContentSource: &csi.VolumeContentSource{
+					Type: &csi.VolumeContentSource_Snapshot{Snapshot: &csi.VolumeContentSource_SnapshotSource{SnapshotId: "snap-1"}},
+				},
+			},
+			code: codes.NotFound,
+		},
+		{
+			name: "clones a volume through a snapshot that is cleaned up",
+			setup: func(cloud *fake.Cloud) {
+				cloud.AddVolume(testVolume("vol-1", "pvc-source", "24", fake.DetachedCloudID))
+			},
+			req: &csi.CreateVolumeRequest{
+				Name:               "pvc-1",
+				VolumeCapabilities: mountCapabilities(),
+				VolumeContentSource: &csi.VolumeContentSource{
+					Type: &csi.VolumeContentSource_Volume{Volume: &csi.VolumeContentSource_VolumeSource{VolumeId: "vol-1"}},
+				},
+			},
+			code: codes.OK,
+			check: func(t *testing.T, res *csi.CreateVolumeResponse, cloud *fake.Cloud) {
+				if res.Volume.CapacityBytes != 24*giB {
+					t.Errorf("capacity %d, want the source size %d", res.Volume.CapacityBytes, 24*giB)
+				}
+				snapshots, _ := cloud.ListSnapshots(context.Background())
+				if len(snapshots) != 0 {
+					t.Errorf("clone snapshots were left behind: %v", snapshots)
+				}
+			},
+		},
+		{
+			name: "waits for the clone snapshot",
+			setup: func(cloud *fake.Cloud) {
+				cloud.AddVolume(testVolume("vol-1", "pvc-source", "24", fake.DetachedCloudID))
+				cloud.HoldSnapshots()
+			},
+			req: &csi.CreateVolumeRequest{
+				Name:               "pvc-1",
+				VolumeCapabilities: mountCapabilities(),
+				VolumeContentSource: &csi.VolumeContentSource{
+					Type: &csi.VolumeContentSource_Volume{Volume: &csi.VolumeContentSource_VolumeSource{VolumeId: "vol-1"}},
+				},
+			},
+			code: codes.Unavailable,
+		},
+		{
+			name: "rejects a missing name",
+			req:  &csi.CreateVolumeRequest{VolumeCapabilities: mountCapabilities()},
+			code: codes.InvalidArgument,
+		},
+		{
+			name: "rejects missing capabilities",
+			req:  &csi.CreateVolumeRequest{Name: "pvc-1"},
+			code: codes.InvalidArgument,
+		},
+		{
+			name: "rejects an unsupported access mode",
+			req: &csi.CreateVolumeRequest{
+				Name: "pvc-1",
+				VolumeCapabilities: []*csi.VolumeCapability{
+					{
+						AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+						AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER},
+					},
+				},
+			},
+			code: codes.InvalidArgument,
+		},
+		{
+			name: "rejects an unknown parameter",
+			req: &csi.CreateVolumeRequest{
+				Name:               "pvc-1",
+				VolumeCapabilities: mountCapabilities(),
+				Parameters:         map[string]string{"encrypted": "true"},
+			},
+			code: codes.InvalidArgument,
+		},
+		{
+			name: "rejects a size above the maximum",
+			req: &csi.CreateVolumeRequest{
+				Name:               "pvc-1",
+				VolumeCapabilities: mountCapabilities(),
+				CapacityRange:      &csi.CapacityRange{RequiredBytes: 32 * 1024 * giB},
+			},
+			code: codes.OutOfRange,
+		},
+		{
+			name: "reports an exhausted quota",
+			setup: func(cloud *fake.Cloud) {
+				cloud.SetQuota(testDcslug, 10)
+			},
+			req:  &csi.CreateVolumeRequest{Name: "pvc-1", VolumeCapabilities: mountCapabilities()},
+			code: codes.ResourceExhausted,
+		},
+		{
+			name: "reports an unavailable API",
+			setup: func(cloud *fake.Cloud) {
+				cloud.SetError(fake.OpCreateVolume, unavailable)
+			},
+			req:  &csi.CreateVolumeRequest{Name: "pvc-1", VolumeCapabilities: mountCapabilities()},
+			code: codes.Unavailable,
+		},
+		{
+			name: "reports rejected credentials",
+			setup: func(cloud *fake.Cloud) {
+				cloud.SetError(fake.OpListVolumes, fake.APIError(http.StatusUnauthorized, "Unauthorized"))
+			},
+			req:  &csi.CreateVolumeRequest{Name: "pvc-1", VolumeCapabilities: mountCapabilities()},
+			code: codes.Unauthenticated,
+		},
+		{
+			name: "does not blame the request for a response that isn't JSON",
+			setup: func(cloud *fake.Cloud) {
+				var v struct{}
+				cloud.SetError(fake.OpCreateVolume, json.Unmarshal([]byte("<html>502 Bad Gateway</html>"), &v))
+			},
+			req:  &csi.CreateVolumeRequest{Name: "pvc-1", VolumeCapabilities: mountCapabilities()},
+			code: codes.Internal,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			controller, cloud := newTestController(t)
+			if tt.setup != nil {
+				tt.setup(cloud)
+			}
+
+			res, err := controller.CreateVolume(context.Background(), tt.req)
+			checkCode(t, err, tt.code)
+			if tt.check != nil {
+				tt.check(t, res, cloud)
+			}
+		})
+	}
+}
+
+func cloneRequest(name, sourceID string) *csi.CreateVolumeRequest {
+	return &csi.CreateVolumeRequest{
+		Name:               name,
+		VolumeCapabilities: mountCapabilities(),
+		VolumeContentSource: &csi.VolumeContentSource{
+			Type: &csi.VolumeContentSource_Volume{Volume: &csi.VolumeContentSource_VolumeSource{VolumeId: sourceID}},
+		},
+	}
+}
+
+func TestCreateVolumeKeepsTheCloneSnapshotUntilTheRestoreIsDone(t *testing.T) {
+	controller, cloud := newTestController(t)
+	cloud.AddVolume(testVolume("vol-1", "pvc-source", "24", fake.DetachedCloudID))
+	cloud.HoldRestores()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err := controller.CreateVolume(ctx, cloneRequest("pvc-1", "vol-1"))
+	checkCode(t, err, codes.DeadlineExceeded)
+
+	if snapshots, _ := cloud.ListSnapshots(context.Background()); len(snapshots) != 1 {
+		t.Fatalf("got %d clone snapshots while the restore is pending, want 1", len(snapshots))
+	}
+
+	cloud.ReleaseRestores()
+
+	_, err = controller.CreateVolume(context.Background(), cloneRequest("pvc-1", "vol-1"))
+	checkCode(t, err, codes.OK)
+
+	if calls := cloud.Calls(fake.OpCreateVolume); calls != 1 {
+		t.Errorf("create was requested %d times, want once", calls)
+	}
+	if snapshots, _ := cloud.ListSnapshots(context.Background()); len(snapshots) != 0 {
+		t.Errorf("clone snapshots were left behind by the retry: %v", snapshots)
+	}
+}
+
+func TestCreateVolumeCloneFailure(t *testing.T) {
+	tests := []struct {
+		name          string
+		err           error
+		code          codes.Code
+		wantSnapshots int
+	}{
+		{
+			name:          "deletes the snapshot when the create is rejected",
+			err:           fake.APIError(http.StatusBadRequest, "disk must be a positive number of GB"),
+			code:          codes.InvalidArgument,
+			wantSnapshots: 0,
+		},
+		{
+			name:          "keeps the snapshot when the volume may have been created",
+			err:           fake.APIError(http.StatusBadGateway, ""),
+			code:          codes.Unavailable,
+			wantSnapshots: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			controller, cloud := newTestController(t)
+			cloud.AddVolume(testVolume("vol-1", "pvc-source", "24", fake.DetachedCloudID))
+			cloud.FailOnce(fake.OpCreateVolume, tt.err)
+
+			_, err := controller.CreateVolume(context.Background(), cloneRequest("pvc-1", "vol-1"))
+			checkCode(t, err, tt.code)
+
+			if snapshots, _ := cloud.ListSnapshots(context.Background()); len(snapshots) != tt.wantSnapshots {
+				t.Errorf("got %d clone snapshots, want %d", len(snapshots), tt.wantSnapshots)
+			}
+		})
+	}
+}
+
+func TestDeleteVolume(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(*fake.Cloud)
+		req   *csi.DeleteVolumeRequest
+		code  codes.Code
+		check func(*testing.T, *fake.Cloud)
+	}{
+		{
+			name: "deletes the volume",
+			setup: func(cloud *fake.Cloud) {
+				cloud.AddVolume(testVolume("vol-1", "pvc-1", "16", fake.DetachedCloudID))
+			},
+			req:  &csi.DeleteVolumeRequest{VolumeId: "vol-1"},
+			code: codes.OK,
+			check: func(t *testing.T, cloud *fake.Cloud) {
+				if _, ok := cloud.Volume("vol-1"); ok {
+					t.Error("volume was not deleted")
+				}
+			},
+		},
+		{
+			name: "succeeds for a volume that doesn't exist",
+			req:  &csi.DeleteVolumeRequest{VolumeId: "vol-1"},
+			code: codes.OK,
+			check: func(t *testing.T, cloud *fake.Cloud) {
+				if calls := cloud.Calls(fake.OpDeleteVolume); calls != 0 {
+					t.Errorf("delete was called %d times, want 0", calls)
+				}
+			},
+		},
+		{
+			name: "succeeds when the volume disappears before the delete",
+			setup: func(cloud *fake.Cloud) {
+				cloud.AddVolume(testVolume("vol-1", "pvc-1", "16", fake.DetachedCloudID))
+				cloud.FailOnce(fake.OpDeleteVolume, fake.APIError(http.StatusNotFound, "Block storage not found"))
+			},
+			req:  &csi.DeleteVolumeRequest{VolumeId: "vol-1"},
+			code: codes.OK,
+		},
+		{
+			name: "rejects a missing volume id",
+			req:  &csi.DeleteVolumeRequest{},
+			code: codes.InvalidArgument,
+		},
+		{
+			name: "reports a rate limited API",
+			setup: func(cloud *fake.Cloud) {
+				cloud.AddVolume(testVolume("vol-1", "pvc-1", "16", fake.DetachedCloudID))
+				cloud.SetError(fake.OpDeleteVolume, fake.APIError(http.StatusTooManyRequests, "Too Many Requests"))
+			},
+			req:  &csi.DeleteVolumeRequest{VolumeId: "vol-1"},
+			code: codes.Unavailable,
+		},
+		{
+			name: "refuses to delete an attached volume",
+			setup: func(cloud *fake.Cloud) {
+				cloud.AddVolume(testVolume("vol-1", "pvc-1", "16", testNodeID))
+			},
+			req:  &csi.DeleteVolumeRequest{VolumeId: "vol-1"},
+			code: codes.FailedPrecondition,
+			check: func(t *testing.T, cloud *fake.Cloud) {
+				if _, ok := cloud.Volume("vol-1"); !ok {
+					t.Error("attached volume was deleted")
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			controller, cloud := newTestController(t)
+			if tt.setup != nil {
+				tt.setup(cloud)
+			}
+
+			_, err := controller.DeleteVolume(context.Background(), tt.req)
+			checkCode(t, err, tt.code)
+			if tt.check != nil {
+				tt.check(t, cloud)
+			}
+		})
+	}
+}
+
+func TestControllerPublishVolume(t *testing.T) {
+	tests := []struct {
+		name    string
+		setup   func(*fake.Cloud)
+		req     *csi.ControllerPublishVolumeRequest
+		timeout time.Duration
+		code    codes.Code
+		check   func(*testing.T, *csi.ControllerPublishVolumeResponse, *fake.Cloud)
+	}{
+		{
+			name: "attaches the volume to the node",
+			setup: func(cloud *fake.Cloud) {
+				cloud.AddVolume(testVolume("vol-1", "pvc-1", "16", fake.DetachedCloudID))
+			},
+			req:  &csi.ControllerPublishVolumeRequest{VolumeId: "vol-1", NodeId: testNodeID, VolumeCapability: mountCapabilities()[0]},
+			code: codes.OK,
+			check: func(t *testing.T, res *csi.ControllerPublishVolumeResponse, cloud *fake.Cloud) {
+				volume, _ := cloud.Volume("vol-1")
+				if volume.Cloudid != testNodeID {
+					t.Errorf("volume is attached to %q, want %q", volume.Cloudid, testNodeID)
+				}
+				if len(res.PublishContext) == 0 {
+					t.Error("publish context is empty")
+				}
+			},
+		},
+		{
+			name: "succeeds when the volume is already attached to the node",
+			setup: func(cloud *fake.Cloud) {
+				cloud.AddVolume(testVolume("vol-1", "pvc-1", "16", testNodeID))
+			},
+			req:  &csi.ControllerPublishVolumeRequest{VolumeId: "vol-1", NodeId: testNodeID, VolumeCapability: mountCapabilities()[0]},
+			code: codes.OK,
+			check: func(t *testing.T, _ *csi.ControllerPublishVolumeResponse, cloud *fake.Cloud) {
+				if calls := cloud.Calls(fake.OpAttachVolume); calls != 0 {
+					t.Errorf("attach was called %d times, want 0", calls)
+				}
+			},
+		},
+		{
+			name: "rejects a volume attached to another node",
+			setup: func(cloud *fake.Cloud) {
+				cloud.AddVolume(testVolume("vol-1", "pvc-1", "16", "node-2"))
+			},
+			req:  &csi.ControllerPublishVolumeRequest{VolumeId: "vol-1", NodeId: testNodeID, VolumeCapability: mountCapabilities()[0]},
+			code: codes.FailedPrecondition,
+		},
+		{
+			name: "rejects a node that is not in any nodepool",
+			setup: func(cloud *fake.Cloud) {
+				cloud.AddVolume(testVolume("vol-1", "pvc-1", "16", fake.DetachedCloudID))
+				cloud.AddCluster("cluster-1", testDcslug)
+				_ = cloud.AddNodepool("cluster-1", "pool-1", fake.Worker{Hostname: "worker-1", Cloudid: "node-2"})
+			},
+			req:  &csi.ControllerPublishVolumeRequest{VolumeId: "vol-1", NodeId: testNodeID, VolumeCapability: mountCapabilities()[0]},
+			code: codes.NotFound,
+		},
+		{
+			name: "times out when the attachment doesn't complete",
+			setup: func(cloud *fake.Cloud) {
+				cloud.AddVolume(testVolume("vol-1", "pvc-1", "16", fake.DetachedCloudID))
+				cloud.HoldAttachments()
+			},
+			req:     &csi.ControllerPublishVolumeRequest{VolumeId: "vol-1", NodeId: testNodeID, VolumeCapability: mountCapabilities()[0]},
+			timeout: 100 * time.Millisecond,
+			code:    codes.DeadlineExceeded,
+		},
+		{
+			name: "reports a missing volume",
+			req:  &csi.ControllerPublishVolumeRequest{VolumeId: "vol-1", NodeId: testNodeID, VolumeCapability: mountCapabilities()[0]},
+			code: codes.NotFound,
+		},
+		{
+			name: "reports an unavailable API instead of a missing volume",
+			setup: func(cloud *fake.Cloud) {
+				cloud.AddVolume(testVolume("vol-1", "pvc-1", "16", fake.DetachedCloudID))
+				cloud.SetError(fake.OpGetVolume, fake.APIError(http.StatusBadGateway, "Bad Gateway"))
+			},
+			req:  &csi.ControllerPublishVolumeRequest{VolumeId: "vol-1", NodeId: testNodeID, VolumeCapability: mountCapabilities()[0]},
+			code: codes.Unavailable,
+		},
+		{
+			name: "rejects a missing node id",
+			req:  &csi.ControllerPublishVolumeRequest{VolumeId: "vol-1", VolumeCapability: mountCapabilities()[0]},
+			code: codes.InvalidArgument,
+		},
+		{
+			name: "rejects a missing capability",
+			req:  &csi.ControllerPublishVolumeRequest{VolumeId: "vol-1", NodeId: testNodeID},
+			code: codes.InvalidArgument,
+		},
+		{
+			name: "rejects read only",
+			req:  &csi.ControllerPublishVolumeRequest{VolumeId: "vol-1", NodeId: testNodeID, VolumeCapability: mountCapabilities()[0], Readonly: true},
+			code: codes.InvalidArgument,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			controller, cloud := newTestController(t)
+			if tt.setup != nil {
+				tt.setup(cloud)
+			}
+
+			ctx := context.Background()
+			if tt.timeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, tt.timeout)
+				defer cancel()
+			}
+
+			res, err := controller.ControllerPublishVolume(ctx, tt.req)
+			checkCode(t, err, tt.code)
+			if tt.check != nil {
+				tt.check(t, res, cloud)
+			}
+		})
+	}
+}
+
+func TestControllerUnpublishVolume(t *testing.T) {
+	tests := []struct {
+		name    string
+		setup   func(*fake.Cloud)
+		req     *csi.ControllerUnpublishVolumeRequest
+		timeout time.Duration
+		code    codes.Code
+		check   func(*testing.T, *fake.Cloud)
+	}{
+		{
+			name: "detaches the volume from the node",
+			setup: func(cloud *fake.Cloud) {
+				cloud.AddVolume(testVolume("vol-1", "pvc-1", "16", testNodeID))
+			},
+			req:  &csi.ControllerUnpublishVolumeRequest{VolumeId: "vol-1", NodeId: testNodeID},
+			code: codes.OK,
+			check: func(t *testing.T, cloud *fake.Cloud) {
+				volume, _ := cloud.Volume("vol-1")
+				if volume.Cloudid != fake.DetachedCloudID {
+					t.Errorf("volume is attached to %q, want it detached", volume.Cloudid)
+				}
+			},
+		},
+		{
+			name: "succeeds for a detached volume",
+			setup: func(cloud *fake.Cloud) {
+				cloud.AddVolume(testVolume("vol-1", "pvc-1", "16", fake.DetachedCloudID))
+			},
+			req:  &csi.ControllerUnpublishVolumeRequest{VolumeId: "vol-1", NodeId: testNodeID},
+			code: codes.OK,
+			check: func(t *testing.T, cloud *fake.Cloud) {
+				if calls := cloud.Calls(fake.OpDetachVolume); calls != 0 {
+					t.Errorf("detach was called %d times, want 0", calls)
+				}
+			},
+		},
+		{
+			name: "leaves a volume attached to another node alone",
+			setup: func(cloud *fake.Cloud) {
+				cloud.AddVolume(testVolume("vol-1", "pvc-1", "16", "node-2"))
+			},
+			req:  &csi.ControllerUnpublishVolumeRequest{VolumeId: "vol-1", NodeId: testNodeID},
+			code: codes.OK,
+			check: func(t *testing.T, cloud *fake.Cloud) {
+				volume, _ := cloud.Volume("vol-1")
+				if volume.Cloudid != "node-2" {
+					t.Errorf("volume is attached to %q, want node-2", volume.Cloudid)
+				}
+			},
+		},
+		{
+			name: "succeeds when the API says the volume is not attached",
+			setup: func(cloud *fake.Cloud) {
+				cloud.AddVolume(testVolume("vol-1", "pvc-1", "16", testNodeID))
+				cloud.FailOnce(fake.OpDetachVolume, fake.APIError(http.StatusBadRequest, "Block storage volume is not currently attached to a server"))
+			},
+			req:  &csi.ControllerUnpublishVolumeRequest{VolumeId: "vol-1", NodeId: testNodeID},
+			code: codes.OK,
+		},
+		{
+			name: "succeeds for a volume that doesn't exist",
+			req:  &csi.ControllerUnpublishVolumeRequest{VolumeId: "vol-1", NodeId: testNodeID},
+			code: codes.OK,
+		},
+		{
+			name: "times out when the detachment doesn't complete",
+			setup: func(cloud *fake.Cloud) {
+				cloud.AddVolume(testVolume("vol-1", "pvc-1", "16", testNodeID))
+				cloud.HoldAttachments()
+			},
+			req:     &csi.ControllerUnpublishVolumeRequest{VolumeId: "vol-1", NodeId: testNodeID},
+			timeout: 100 * time.Millisecond,
+			code:    codes.DeadlineExceeded,
+		},
+		{
+			name: "reports an unavailable API",
+			setup: func(cloud *fake.Cloud) {
+				cloud.AddVolume(testVolume("vol-1", "pvc-1", "16", testNodeID))
+				cloud.SetError(fake.OpGetVolume, fake.APIError(http.StatusServiceUnavailable, "Service Unavailable"))
+			},
+			req:  &csi.ControllerUnpublishVolumeRequest{VolumeId: "vol-1", NodeId: testNodeID},
+			code: codes.Unavailable,
+		},
+		{
+			name: "rejects a missing node id",
+			req:  &csi.ControllerUnpublishVolumeRequest{VolumeId: "vol-1"},
+			code: codes.InvalidArgument,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			controller, cloud := newTestController(t)
+			if tt.setup != nil {
+				tt.setup(cloud)
+			}
+
+			ctx := context.Background()
+			if tt.timeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, tt.timeout)
+				defer cancel()
+			}
+
+			_, err := controller.ControllerUnpublishVolume(ctx, tt.req)
+			checkCode(t, err, tt.code)
+			if tt.check != nil {
+				tt.check(t, cloud)
+			}
+		})
+	}
+}
+
+func TestControllerPublishVolumeRetryAfterTimeout(t *testing.T) {
+	controller, cloud := newTestController(t)
+	cloud.AddVolume(testVolume("vol-1", "pvc-1", "16", fake.DetachedCloudID))
+	cloud.HoldAttachments()
+
+	req := &csi.ControllerPublishVolumeRequest{
+		VolumeId:         "vol-1",
+		NodeId:           testNodeID,
+		VolumeCapability: mountCapabilities()[0],
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err := controller.ControllerPublishVolume(ctx, req)
+	checkCode(t, err, codes.DeadlineExceeded)
+
+	// Utho doesn't report the attach, the controller remembers it
+	res, err := controller.ControllerGetVolume(context.Background(), &csi.ControllerGetVolumeRequest{VolumeId: "vol-1"})
+	checkCode(t, err, codes.OK)
+	if condition := res.Status.VolumeCondition; !strings.Contains(condition.GetMessage(), "attaching") || condition.GetAbnormal() {
+		t.Errorf("got condition %v, want a normal attaching volume", condition)
+	}
+
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		cloud.ReleaseAttachments()
+	}()
+
+	_, err = controller.ControllerPublishVolume(context.Background(), req)
+	checkCode(t, err, codes.OK)
+
+	if calls := cloud.Calls(fake.OpAttachVolume); calls != 1 {
+		t.Errorf("attach was requested %d times, want once", calls)
+	}
+	if volume, _ := cloud.Volume("vol-1"); volume.Cloudid != testNodeID {
+		t.Errorf("volume is attached to %q, want %q", volume.Cloudid, testNodeID)
+	}
+}
+
+func TestControllerPublishVolumeStopsWaitingForADeletedVolume(t *testing.T) {
+	controller, cloud := newTestController(t)
+	cloud.AddVolume(testVolume("vol-1", "pvc-1", "16", fake.DetachedCloudID))
+	cloud.HoldAttachments()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	published := make(chan error, 1)
+	go func() {
+		_, err := controller.ControllerPublishVolume(ctx, &csi.ControllerPublishVolumeRequest{VolumeId: "vol-1", NodeId: testNodeID, VolumeCapability: mountCapabilities()[0]})
+		published <- err
+	}()
+	waitForCall(t, cloud, fake.OpAttachVolume)
+
+	// deleted behind the driver's back while the attach is pending
+	if err := cloud.DeleteVolume(context.Background(), "vol-1"); err != nil {
+		t.Fatalf("cannot delete volume: %v", err)
+	}
+
+	checkCode(t, <-published, codes.NotFound)
+}
+
+func TestControllerPublishVolumeWhileAttachingToAnotherNode(t *testing.T) {
+	controller, cloud := newTestController(t)
+	cloud.AddVolume(testVolume("vol-1", "pvc-1", "16", fake.DetachedCloudID))
+	cloud.HoldAttachments()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err := controller.ControllerPublishVolume(ctx, &csi.ControllerPublishVolumeRequest{
+		VolumeId:         "vol-1",
+		NodeId:           "node-2",
+		VolumeCapability: mountCapabilities()[0],
+	})
+	checkCode(t, err, codes.DeadlineExceeded)
+
+	_, err = controller.ControllerPublishVolume(context.Background(), &csi.ControllerPublishVolumeRequest{
+		VolumeId:         "vol-1",
+		NodeId:           testNodeID,
+		VolumeCapability: mountCapabilities()[0],
+	})
+	checkCode(t, err, codes.FailedPrecondition)
+}
+
+func TestControllerUnpublishVolumeRetryAfterTimeout(t *testing.T) {
+	controller, cloud := newTestController(t)
+	cloud.AddVolume(testVolume("vol-1", "pvc-1", "16", testNodeID))
+	cloud.HoldAttachments()
+
+	req := &csi.ControllerUnpublishVolumeRequest{VolumeId: "vol-1", NodeId: testNodeID}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err := controller.ControllerUnpublishVolume(ctx, req)
+	checkCode(t, err, codes.DeadlineExceeded)
+
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		cloud.ReleaseAttachments()
+	}()
+
+	_, err = controller.ControllerUnpublishVolume(context.Background(), req)
+	checkCode(t, err, codes.OK)
+
+	if calls := cloud.Calls(fake.OpDetachVolume); calls != 1 {
+		t.Errorf("detach was requested %d times, want once", calls)
+	}
+	if volume, _ := cloud.Volume("vol-1"); volume.Cloudid != fake.DetachedCloudID {
+		t.Errorf("volume is attached to %q, want it detached", volume.Cloudid)
+	}
+}
+
+func TestVolumeOwnership(t *testing.T) {
+	const (
+		clusterID = "cluster-1"
+		// volumes created before names were prefixed with the cluster are named after their PV,
+		// with the whole uid of the PVC or the 16 digits --volume-name-uuid-length=16 keeps
+		legacyName      = "pvc-0b5e6a7c-3f1d-4c2e-9a8b-7d6c5e4f3a2b"
+		legacyShortName = "pvc-0b5e6a7c3f1d4c2e"
+	)
+
+	setup := func(t *testing.T, opts ...driver.DriverOption) (*driver.UthoControllerServer, *fake.Cloud) {
+		controller, cloud := newTestController(t, append(opts, driver.WithClusterID(clusterID))...)
+		cloud.AddVolume(testVolume("vol-own", "csi-cluster-1-pvc-own", "16", fake.DetachedCloudID))
+		cloud.AddVolume(testVolume("vol-other", "csi-cluster-2-pvc-other", "16", fake.DetachedCloudID))
+		cloud.AddVolume(testVolume("vol-foreign", "pvc-foreign", "16", fake.DetachedCloudID))
+		cloud.AddVolume(testVolume("vol-legacy", legacyName, "16", fake.DetachedCloudID))
+		cloud.AddVolume(testVolume("vol-legacy-short", legacyShortName, "16", fake.DetachedCloudID))
+		return controller, cloud
+	}
+
+	publishRequest := func(volumeID string) *csi.ControllerPublishVolumeRequest {
+		return &csi.ControllerPublishVolumeRequest{
+			VolumeId:         volumeID,
+			NodeId:           testNodeID,
+			VolumeCapability: mountCapabilities()[0],
+		}
+	}
+
+	t.Run("names new volumes after the cluster", func(t *testing.T) {
+		controller, cloud := setup(t)
+		req := &csi.CreateVolumeRequest{Name: "pvc-1", VolumeCapabilities: mountCapabilities()}
+
+		res, err := controller.CreateVolume(context.Background(), req)
+		checkCode(t, err, codes.OK)
+		if volume, _ := cloud.Volume(res.Volume.VolumeId); volume.Name != "csi-cluster-1-pvc-1" {
+			t.Errorf("volume is named %q, want it prefixed with the cluster", volume.Name)
+		}
+
+		// a retry has to recognize the volume by its name
+		retry, err := controller.CreateVolume(context.Background(), req)
+		checkCode(t, err, codes.OK)
+		if retry.Volume.VolumeId != res.Volume.VolumeId {
+			t.Errorf("retry returned volume %q, want %q", retry.Volume.VolumeId, res.Volume.VolumeId)
+		}
+		if calls := cloud.Calls(fake.OpCreateVolume); calls != 1 {
+			t.Errorf("create was requested %d times, want once", calls)
+		}
+	})
+
+	t.Run("does not reuse a foreign volume of the same name", func(t *testing.T) {
+		controller, _ := setup(t)
+
+		res, err := controller.CreateVolume(context.Background(), &csi.CreateVolumeRequest{Name: "pvc-foreign", VolumeCapabilities: mountCapabilities()})
+		checkCode(t, err, codes.OK)
+		if res.Volume.VolumeId == "vol-foreign" {
+			t.Error("CreateVolume returned the foreign volume")
+		}
+	})
+
+	t.Run("lists only its own volumes", func(t *testing.T) {
+		controller, _ := setup(t)
+
+		res, err := controller.ListVolumes(context.Background(), &csi.ListVolumesRequest{})
+		checkCode(t, err, codes.OK)
+
+		var ids []string
+		for _, entry := range res.Entries {
+			ids = append(ids, entry.Volume.VolumeId)
+		}
+		if len(ids) != 3 || ids[0] != "vol-legacy" || ids[1] != "vol-legacy-short" || ids[2] != "vol-own" {
+			t.Errorf("listed volumes %v, want vol-legacy, vol-legacy-short and vol-own", ids)
+		}
+	})
+
+	t.Run("keeps managing volumes named before the cluster prefix", func(t *testing.T) {
+		controller, cloud := setup(t)
+
+		// a retry of the CreateVolume that made the volume must not create another one
+		res, err := controller.CreateVolume(context.Background(), &csi.CreateVolumeRequest{Name: legacyName, VolumeCapabilities: mountCapabilities()})
+		checkCode(t, err, codes.OK)
+		if res.Volume.VolumeId != "vol-legacy" {
+			t.Errorf("CreateVolume returned volume %q, want vol-legacy", res.Volume.VolumeId)
+		}
+		if calls := cloud.Calls(fake.OpCreateVolume); calls != 0 {
+			t.Errorf("create was requested %d times, want 0", calls)
+		}
+
+		_, err = controller.ControllerPublishVolume(context.Background(), publishRequest("vol-legacy"))
+		checkCode(t, err, codes.OK)
+		_, err = controller.ControllerUnpublishVolume(context.Background(), &csi.ControllerUnpublishVolumeRequest{VolumeId: "vol-legacy", NodeId: testNodeID})
+		checkCode(t, err, codes.OK)
+		_, err = controller.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: "vol-legacy"})
+		checkCode(t, err, codes.OK)
+		if _, ok := cloud.Volume("vol-legacy"); ok {
+			t.Error("legacy volume was not deleted")
+		}
+
+		_, err = controller.ControllerPublishVolume(context.Background(), publishRequest("vol-legacy-short"))
+		checkCode(t, err, codes.OK)
+	})
+
+	t.Run("refuses to change foreign volumes", func(t *testing.T) {
+		controller, cloud := setup(t)
+		cloud.AddVolume(testVolume("vol-attached", "pvc-attached", "16", testNodeID))
+
+		for _, volumeID := range []string{"vol-other", "vol-foreign"} {
+			_, err := controller.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: volumeID})
+			checkCode(t, err, codes.FailedPrecondition)
+
+			_, err = controller.ControllerPublishVolume(context.Background(), publishRequest(volumeID))
+			checkCode(t, err, codes.FailedPrecondition)
+
+			_, err = controller.ControllerExpandVolume(context.Background(), &csi.ControllerExpandVolumeRequest{
+				VolumeId:      volumeID,
+				CapacityRange: &csi.CapacityRange{RequiredBytes: 32 * giB},
+			})
+			checkCode(t, err, codes.FailedPrecondition)
+
+			_, err = controller.ControllerModifyVolume(context.Background(), &csi.ControllerModifyVolumeRequest{
+				VolumeId:          volumeID,
+				MutableParameters: map[string]string{"iops": "4000"},
+			})
+			checkCode(t, err, codes.FailedPrecondition)
+
+			_, err = controller.CreateSnapshot(context.Background(), &csi.CreateSnapshotRequest{Name: "snap-" + volumeID, SourceVolumeId: volumeID})
+			checkCode(t, err, codes.FailedPrecondition)
+
+			_, err = controller.CreateVolume(context.Background(), cloneRequest("clone-of-"+volumeID, volumeID))
+			checkCode(t, err, codes.FailedPrecondition)
+		}
+
+		_, err := controller.ControllerUnpublishVolume(context.Background(), &csi.ControllerUnpublishVolumeRequest{VolumeId: "vol-attached", NodeId: testNodeID})
+		checkCode(t, err, codes.FailedPrecondition)
+
+		for _, op := range []string{fake.OpDeleteVolume, fake.OpAttachVolume, fake.OpDetachVolume, fake.OpResizeVolume, fake.OpCreateSnapshot} {
+			if calls := cloud.Calls(op); calls != 0 {
+				t.Errorf("got %d %s requests for foreign volumes", calls, op)
+			}
+		}
+	})
+
+	t.Run("adopts foreign volumes when allowed", func(t *testing.T) {
+		controller, cloud := setup(t, driver.WithAdoptForeignVolumes(true))
+
+		_, err := controller.ControllerPublishVolume(context.Background(), publishRequest("vol-foreign"))
+		checkCode(t, err, codes.OK)
+
+		_, err = controller.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: "vol-other"})
+		checkCode(t, err, codes.OK)
+		if _, ok := cloud.Volume("vol-other"); ok {
+			t.Error("adopted volume was not deleted")
+		}
+	})
+}
+
+func TestCreateVolumeNamesTheVolumeAfterItsPVC(t *testing.T) {
+	controller, cloud := newTestController(t, driver.WithClusterID("cluster-1"))
+
+	req := &csi.CreateVolumeRequest{
+		Name:               "pvc-1",
+		VolumeCapabilities: mountCapabilities(),
+		Parameters: map[string]string{
+			"type":                             "ssd",
+			"csi.storage.k8s.io/pvc/name":      "data",
+			"csi.storage.k8s.io/pvc/namespace": "default",
+			"csi.storage.k8s.io/pv/name":       "pvc-1",
+		},
+	}
+
+	res, err := controller.CreateVolume(context.Background(), req)
+	checkCode(t, err, codes.OK)
+
+	volume, _ := cloud.Volume(res.Volume.VolumeId)
+	if want := "csi-cluster-1-pvc-1-default-data"; volume.Name != want {
+		t.Errorf("volume is named %q, want %q", volume.Name, want)
+	}
+
+	retry, err := controller.CreateVolume(context.Background(), req)
+	checkCode(t, err, codes.OK)
+	if retry.Volume.VolumeId != res.Volume.VolumeId {
+		t.Errorf("retry returned volume %q, want %q", retry.Volume.VolumeId, res.Volume.VolumeId)
+	}
+}
+
+func TestValidateVolumeCapabilities(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(*fake.Cloud)
+		req   *csi.ValidateVolumeCapabilitiesRequest
+		code  codes.Code
+	}{
+		{
+			name: "confirms the capabilities",
+			setup: func(cloud *fake.Cloud) {
+				cloud.AddVolume(testVolume("vol-1", "pvc-1", "16", fake.DetachedCloudID))
+			},
+			req:  &csi.ValidateVolumeCapabilitiesRequest{VolumeId: "vol-1", VolumeCapabilities: mountCapabilities()},
+			code: codes.OK,
+		},
+		{
+			name: "reports a missing volume",
+			req:  &csi.ValidateVolumeCapabilitiesRequest{VolumeId: "vol-1", VolumeCapabilities: mountCapabilities()},
+			code: codes.NotFound,
+		},
+		{
+			name: "rejects missing capabilities",
+			req:  &csi.ValidateVolumeCapabilitiesRequest{VolumeId: "vol-1"},
+			code: codes.InvalidArgument,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			controller, cloud := newTestController(t)
+			if tt.setup != nil {
+				tt.setup(cloud)
+			}
+
+			res, err := controller.ValidateVolumeCapabilities(context.Background(), tt.req)
+			checkCode(t, err, tt.code)
+			if err == nil && res.Confirmed == nil {
+				t.Error("capabilities were not confirmed")
+			}
+		})
+	}
+}
+
+func TestListVolumes(t *testing.T) {
+	setup := func(cloud *fake.Cloud) {
+		cloud.AddVolume(testVolume("vol-1", "pvc-1", "16", testNodeID))
+		cloud.AddVolume(testVolume("vol-2", "pvc-2", "32", fake.DetachedCloudID))
+		cloud.AddVolume(testVolume("vol-3", "pvc-3", "8", fake.DetachedCloudID))
+	}
+
+	tests := []struct {
+		name      string
+		setup     func(*fake.Cloud)
+		req       *csi.ListVolumesRequest
+		code      codes.Code
+		wantIDs   []string
+		wantToken string
+	}{
+		{
+			name:    "lists every volume in order",
+			setup:   setup,
+			req:     &csi.ListVolumesRequest{},
+			code:    codes.OK,
+			wantIDs: []string{"vol-1", "vol-2", "vol-3"},
+		},
+		{
+			name:      "returns the first page",
+			setup:     setup,
+			req:       &csi.ListVolumesRequest{MaxEntries: 2},
+			code:      codes.OK,
+			wantIDs:   []string{"vol-1", "vol-2"},
+			wantToken: "2",
+		},
+		{
+			name:    "returns the next page",
+			setup:   setup,
+			req:     &csi.ListVolumesRequest{MaxEntries: 2, StartingToken: "2"},
+			code:    codes.OK,
+			wantIDs: []string{"vol-3"},
+		},
+		{
+			name:  "rejects an invalid token",
+			setup: setup,
+			req:   &csi.ListVolumesRequest{StartingToken: "not-a-token"},
+			code:  codes.Aborted,
+		},
+		{
+			name: "reports an unavailable API",
+			setup: func(cloud *fake.Cloud) {
+				cloud.SetError(fake.OpListVolumes, fake.APIError(http.StatusInternalServerError, "Internal Server Error"))
+			},
+			req:  &csi.ListVolumesRequest{},
+			code: codes.Unavailable,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			controller, cloud := newTestController(t)
+			tt.setup(cloud)
+
+			res, err := controller.ListVolumes(context.Background(), tt.req)
+			checkCode(t, err, tt.code)
+			if err != nil {
+				return
+			}
+
+			var ids []string
+			for _, entry := range res.Entries {
+				ids = append(ids, entry.Volume.VolumeId)
+			}
+			if strings.Join(ids, ",") != strings.Join(tt.wantIDs, ",") {
+				t.Errorf("volumes %v, want %v", ids, tt.wantIDs)
+			}
+			if res.NextToken != tt.wantToken {
+				t.Errorf("next token %q, want %q", res.NextToken, tt.wantToken)
+			}
+
+			for _, entry := range res.Entries {
+				published := entry.Status.PublishedNodeIds
+				if entry.Volume.VolumeId == "vol-1" && (len(published) != 1 || published[0] != testNodeID) {
+					t.Errorf("vol-1 is published to %v, want [%s]", published, testNodeID)
+				}
+				if entry.Volume.VolumeId != "vol-1" && len(published) != 0 {
+					t.Errorf("%s is published to %v, want none", entry.Volume.VolumeId, published)
+				}
+			}
+		})
+	}
+}
+
+func TestControllerGetVolume(t *testing.T) {
+	tests := []struct {
+		name         string
+		setup        func(*fake.Cloud)
+		req          *csi.ControllerGetVolumeRequest
+		code         codes.Code
+		wantAbnormal bool
+	}{
+		{
+			name: "returns the volume and its node",
+			setup: func(cloud *fake.Cloud) {
+				cloud.AddVolume(testVolume("vol-1", "pvc-1", "16", testNodeID))
+			},
+			req:  &csi.ControllerGetVolumeRequest{VolumeId: "vol-1"},
+			code: codes.OK,
+		},
+		{
+			name: "reports a volume in error as abnormal",
+			setup: func(cloud *fake.Cloud) {
+				volume := testVolume("vol-1", "pvc-1", "16", testNodeID)
+				volume.Status = "Error"
+				cloud.AddVolume(volume)
+			},
+			req:          &csi.ControllerGetVolumeRequest{VolumeId: "vol-1"},
+			code:         codes.OK,
+			wantAbnormal: true,
+		},
+		{
+			name: "reports a missing volume",
+			req:  &csi.ControllerGetVolumeRequest{VolumeId: "vol-1"},
+			code: codes.NotFound,
+		},
+		{
+			name: "rejects a missing volume id",
+			req:  &csi.ControllerGetVolumeRequest{},
+			code: codes.InvalidArgument,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			controller, cloud := newTestController(t)
+			if tt.setup != nil {
+				tt.setup(cloud)
+			}
+
+			res, err := controller.ControllerGetVolume(context.Background(), tt.req)
+			checkCode(t, err, tt.code)
+			if err != nil {
+				return
+			}
+
+			if res.Volume.CapacityBytes != 16*giB {
+				t.Errorf("capacity %d, want %d", res.Volume.CapacityBytes, 16*giB)
+			}
+			if published := res.Status.PublishedNodeIds; len(published) != 1 || published[0] != testNodeID {
+				t.Errorf("published to %v, want [%s]", published, testNodeID)
+			}
+			if abnormal := res.Status.VolumeCondition.GetAbnormal(); abnormal != tt.wantAbnormal {
+				t.Errorf("abnormal %v, want %v", abnormal, tt.wantAbnormal)
+			}
+		})
+	}
+}
+
+func TestControllerExpandVolume(t *testing.T) {
+	tests := []struct {
+		name         string
+		setup        func(*fake.Cloud)
+		req          *csi.ControllerExpandVolumeRequest
+		code         codes.Code
+		wantCapacity int64
+		wantNode     bool
+		wantSizeGB   string
+		check        func(*testing.T, *fake.Cloud)
+	}{
+		{
+			name: "grows the volume rounded up to whole GB",
+			setup: func(cloud *fake.Cloud) {
+				cloud.AddVolume(testVolume("vol-1", "pvc-1", "16", fake.DetachedCloudID))
+			},
+			req:          &csi.ControllerExpandVolumeRequest{VolumeId: "vol-1", CapacityRange: &csi.CapacityRange{RequiredBytes: 20*giB + 1}},
+			code:         codes.OK,
+			wantCapacity: 21 * giB,
+			wantNode:     true,
+			wantSizeGB:   "21",
+		},
+		{
+			name: "doesn't ask the node to grow a block volume",
+			setup: func(cloud *fake.Cloud) {
+				cloud.AddVolume(testVolume("vol-1", "pvc-1", "16", fake.DetachedCloudID))
+			},
+			req: &csi.ControllerExpandVolumeRequest{
+				VolumeId:         "vol-1",
+				CapacityRange:    &csi.CapacityRange{RequiredBytes: 20 * giB},
+				VolumeCapability: blockCapability(),
+			},
+			code:         codes.OK,
+			wantCapacity: 20 * giB,
+			wantNode:     false,
+			wantSizeGB:   "20",
+		},
+		{
+			name: "succeeds when the volume is already big enough",
+			setup: func(cloud *fake.Cloud) {
+				cloud.AddVolume(testVolume("vol-1", "pvc-1", "32", fake.DetachedCloudID))
+			},
+			req:          &csi.ControllerExpandVolumeRequest{VolumeId: "vol-1", CapacityRange: &csi.CapacityRange{RequiredBytes: 20 * giB}},
+			code:         codes.OK,
+			wantCapacity: 32 * giB,
+			wantNode:     true,
+			wantSizeGB:   "32",
+		},
+		{
+			name: "keeps the performance of the volume",
+			setup: func(cloud *fake.Cloud) {
+				volume := testVolume("vol-1", "pvc-1", "16", fake.DetachedCloudID)
+				volume.Iops, volume.Throughput = "6000", "500"
+				cloud.AddVolume(volume)
+			},
+			req:          &csi.ControllerExpandVolumeRequest{VolumeId: "vol-1", CapacityRange: &csi.CapacityRange{RequiredBytes: 20 * giB}},
+			code:         codes.OK,
+			wantCapacity: 20 * giB,
+			wantNode:     true,
+			wantSizeGB:   "20",
+			check: func(t *testing.T, cloud *fake.Cloud) {
+				if volume, _ := cloud.Volume("vol-1"); volume.Iops != "6000" || volume.Throughput != "500" {
+					t.Errorf("iops %q throughput %q, want 6000 and 500", volume.Iops, volume.Throughput)
+				}
+			},
+		},
+		{
+			name: "refuses to round up past the limit",
+			setup: func(cloud *fake.Cloud) {
+				cloud.AddVolume(testVolume("vol-1", "pvc-1", "16", fake.DetachedCloudID))
+			},
+			req: &csi.ControllerExpandVolumeRequest{
+				VolumeId:      "vol-1",
+				CapacityRange: &csi.CapacityRange{RequiredBytes: 20*giB + 1, LimitBytes: 20*giB + 512*1024*1024},
+			},
+			code: codes.OutOfRange,
+		},
+		{
+			name: "refuses to shrink the volume",
+			setup: func(cloud *fake.Cloud) {
+				cloud.AddVolume(testVolume("vol-1", "pvc-1", "32", fake.DetachedCloudID))
+			},
+			req:  &csi.ControllerExpandVolumeRequest{VolumeId: "vol-1", CapacityRange: &csi.CapacityRange{RequiredBytes: 20 * giB, LimitBytes: 20 * giB}},
+			code: codes.OutOfRange,
+		},
+		{
+			name: "reports an exhausted quota",
+			setup: func(cloud *fake.Cloud) {
+				cloud.AddVolume(testVolume("vol-1", "pvc-1", "16", fake.DetachedCloudID))
+				cloud.SetQuota(testDcslug, 18)
+			},
+			req:  &csi.ControllerExpandVolumeRequest{VolumeId: "vol-1", CapacityRange: &csi.CapacityRange{RequiredBytes: 20 * giB}},
+			code: codes.ResourceExhausted,
+		},
+		{
+			name: "reports a missing volume",
+			req:  &csi.ControllerExpandVolumeRequest{VolumeId: "vol-1", CapacityRange: &csi.CapacityRange{RequiredBytes: 20 * giB}},
+			code: codes.NotFound,
+		},
+		{
+			name: "rejects a missing capacity range",
+			req:  &csi.ControllerExpandVolumeRequest{VolumeId: "vol-1"},
+			code: codes.InvalidArgument,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			controller, cloud := newTestController(t)
+			if tt.setup != nil {
+				tt.setup(cloud)
+			}
+
+			res, err := controller.ControllerExpandVolume(context.Background(), tt.req)
+			checkCode(t, err, tt.code)
+			if err != nil {
+				return
+			}
+
+			if res.CapacityBytes != tt.wantCapacity {
+				t.Errorf("capacity %d, want %d", res.CapacityBytes, tt.wantCapacity)
+			}
+			if res.NodeExpansionRequired != tt.wantNode {
+				t.Errorf("node expansion required %v, want %v", res.NodeExpansionRequired, tt.wantNode)
+			}
+			if volume, _ := cloud.Volume("vol-1"); volume.Size != tt.wantSizeGB {
+				t.Errorf("volume size %s GB, want %s GB", volume.Size, tt.wantSizeGB)
+			}
+			if tt.check != nil {
+				tt.check(t, cloud)
+			}
+		})
+	}
+}
+
+func TestCreateSnapshot(t *testing.T) {
+	tests := []struct {
+		name      string
+		setup     func(*fake.Cloud)
+		req       *csi.CreateSnapshotRequest
+		code      codes.Code
+		wantID    string
+		wantReady bool
+	}{
+		{
+			name: "takes a snapshot of the volume",
+			setup: func(cloud *fake.Cloud) {
+				cloud.AddVolume(testVolume("vol-1", "pvc-1", "16", testNodeID))
+			},
+			req:       &csi.CreateSnapshotRequest{Name: "snapshot-1", SourceVolumeId: "vol-1"},
+			code:      codes.OK,
+			wantReady: true,
+		},
+		{
+			name: "reports a snapshot that is not ready yet",
+			setup: func(cloud *fake.Cloud) {
+				cloud.AddVolume(testVolume("vol-1", "pvc-1", "16", testNodeID))
+				cloud.HoldSnapshots()
+			},
+			req:       &csi.CreateSnapshotRequest{Name: "snapshot-1", SourceVolumeId: "vol-1"},
+			code:      codes.OK,
+			wantReady: false,
+		},
+		{
+			name: "returns the existing snapshot with the same name",
+			setup: func(cloud *fake.Cloud) {
+				cloud.AddVolume(testVolume("vol-1", "pvc-1", "16", testNodeID))
+				cloud.AddSnapshot(driver.Snapshot{ID: "snap-1", EbsID: "vol-1", Name: "snapshot-1", Size: "16"})
+			},
+			req:       &csi.CreateSnapshotRequest{Name: "snapshot-1", SourceVolumeId: "vol-1"},
+			code:      codes.OK,
+			wantID:    "snap-1",
+			wantReady: true,
+		},
+		{
+			name: "rejects the same name for another volume",
+			setup: func(cloud *fake.Cloud) {
+				cloud.AddVolume(testVolume("vol-1", "pvc-1", "16", testNodeID))
+				cloud.AddSnapshot(driver.Snapshot{ID: "snap-1", EbsID: "vol-2", Name: "snapshot-1", Size: "16"})
+			},
+			req:  &csi.CreateSnapshotRequest{Name: "snapshot-1", SourceVolumeId: "vol-1"},
+			code: codes.AlreadyExists,
+		},
+		{
+			name: "reports a missing source volume",
+			req:  &csi.CreateSnapshotRequest{Name: "snapshot-1", SourceVolumeId: "vol-1"},
+			code: codes.NotFound,
+		},
+		{
+			name: "rejects a missing name",
+			req:  &csi.CreateSnapshotRequest{SourceVolumeId: "vol-1"},
+			code: codes.InvalidArgument,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			controller, cloud := newTestController(t)
+			if tt.setup != nil {
+				tt.setup(cloud)
+			}
+
+			res, err := controller.CreateSnapshot(context.Background(), tt.req)
+			checkCode(t, err, tt.code)
+			if err != nil {
+				return
+			}
+
+			if tt.wantID != "" && res.Snapshot.SnapshotId != tt.wantID {
+				t.Errorf("snapshot id %s, want %s", res.Snapshot.SnapshotId, tt.wantID)
+			}
+			if res.Snapshot.SourceVolumeId != "vol-1" || res.Snapshot.SizeBytes != 16*giB {
+				t.Errorf("unexpected snapshot %v", res.Snapshot)
+			}
+			if res.Snapshot.ReadyToUse != tt.wantReady {
+				t.Errorf("ready to use %v, want %v", res.Snapshot.ReadyToUse, tt.wantReady)
+			}
+		})
+	}
+}
+
+func TestDeleteSnapshot(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(*fake.Cloud)
+		req   *csi.DeleteSnapshotRequest
+		code  codes.Code
+	}{
+		{
+			name: "deletes the snapshot",
+			setup: func(cloud *fake.Cloud) {
+				cloud.AddSnapshot(driver.Snapshot{ID: "snap-1", EbsID: "vol-1", Size: "16"})
+			},
+			req:  &csi.DeleteSnapshotRequest{SnapshotId: "snap-1"},
+			code: codes.OK,
+		},
+		{
+			name: "succeeds for a snapshot that doesn't exist",
+			req:  &csi.DeleteSnapshotRequest{SnapshotId: "snap-1"},
+			code: codes.OK,
+		},
+		{
+			name: "reports an unavailable API",
+			setup: func(cloud *fake.Cloud) {
+				cloud.AddSnapshot(driver.Snapshot{ID: "snap-1", EbsID: "vol-1", Size: "16"})
+				cloud.SetError(fake.OpDeleteSnapshot, fake.APIError(http.StatusServiceUnavailable, "Service Unavailable"))
+			},
+			req:  &csi.DeleteSnapshotRequest{SnapshotId: "snap-1"},
+			code: codes.Unavailable,
+		},
+		{
+			name: "rejects a missing snapshot id",
+			req:  &csi.DeleteSnapshotRequest{},
+			code: codes.InvalidArgument,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			controller, cloud := newTestController(t)
+			if tt.setup != nil {
+				tt.setup(cloud)
+			}
+
+			_, err := controller.DeleteSnapshot(context.Background(), tt.req)
+			checkCode(t, err, tt.code)
+			if err != nil {
+				return
+			}
+
+			if snapshots, _ := cloud.ListSnapshots(context.Background()); len(snapshots) != 0 {
+				t.Errorf("snapshots %v are left, want none", snapshots)
+			}
+		})
+	}
+}
+
+func TestListSnapshots(t *testing.T) {
+	setup := func(cloud *fake.Cloud) {
+		cloud.AddSnapshot(driver.Snapshot{ID: "snap-1", EbsID: "vol-1", Size: "16"})
+		cloud.AddSnapshot(driver.Snapshot{ID: "snap-2", EbsID: "vol-2", Size: "16"})
+		cloud.AddSnapshot(driver.Snapshot{ID: "snap-3", EbsID: "vol-1", Size: "16"})
+		// taken by the driver to clone vol-1
+		cloud.AddSnapshot(driver.Snapshot{ID: "snap-4", EbsID: "vol-1", Name: "clone-pvc-9", Size: "16"})
+	}
+
+	tests := []struct {
+		name      string
+		req       *csi.ListSnapshotsRequest
+		code      codes.Code
+		wantIDs   []string
+		wantToken string
+	}{
+		{
+			name:    "lists every snapshot in order",
+			req:     &csi.ListSnapshotsRequest{},
+			code:    codes.OK,
+			wantIDs: []string{"snap-1", "snap-2", "snap-3"},
+		},
+		{
+			name:    "filters by source volume",
+			req:     &csi.ListSnapshotsRequest{SourceVolumeId: "vol-1"},
+			code:    codes.OK,
+			wantIDs: []string{"snap-1", "snap-3"},
+		},
+		{
+			name:    "filters by snapshot id",
+			req:     &csi.ListSnapshotsRequest{SnapshotId: "snap-2"},
+			code:    codes.OK,
+			wantIDs: []string{"snap-2"},
+		},
+		{
+			name:    "hides the snapshots taken for clones",
+			req:     &csi.ListSnapshotsRequest{SnapshotId: "snap-4"},
+			code:    codes.OK,
+			wantIDs: nil,
+		},
+		{
+			name:    "returns nothing for an unknown snapshot id",
+			req:     &csi.ListSnapshotsRequest{SnapshotId: "snap-5"},
+			code:    codes.OK,
+			wantIDs: nil,
+		},
+		{
+			name:      "paginates",
+			req:       &csi.ListSnapshotsRequest{MaxEntries: 1, StartingToken: "1"},
+			code:      codes.OK,
+			wantIDs:   []string{"snap-2"},
+			wantToken: "2",
+		},
+		{
+			name: "rejects a token past the end",
+			req:  &csi.ListSnapshotsRequest{StartingToken: "4"},
+			code: codes.Aborted,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			controller, cloud := newTestController(t)
+			setup(cloud)
+
+			res, err := controller.ListSnapshots(context.Background(), tt.req)
+			checkCode(t, err, tt.code)
+			if err != nil {
+				return
+			}
+
+			var ids []string
+			for _, entry := range res.Entries {
+				ids = append(ids, entry.Snapshot.SnapshotId)
+			}
+			if strings.Join(ids, ",") != strings.Join(tt.wantIDs, ",") {
+				t.Errorf("snapshots %v, want %v", ids, tt.wantIDs)
+			}
+			if res.NextToken != tt.wantToken {
+				t.Errorf("next token %q, want %q", res.NextToken, tt.wantToken)
+			}
+		})
+	}
+}
+
+func TestGetCapacity(t *testing.T) {
+	tests := []struct {
+		name          string
+		setup         func(*fake.Cloud)
+		req           *csi.GetCapacityRequest
+		code          codes.Code
+		wantAvailable int64
+	}{
+		{
+			name: "reports the quota left in the datacenter",
+			setup: func(cloud *fake.Cloud) {
+				cloud.SetQuota(testDcslug, 100)
+				cloud.AddVolume(testVolume("vol-1", "pvc-1", "30", fake.DetachedCloudID))
+			},
+			req:           &csi.GetCapacityRequest{VolumeCapabilities: mountCapabilities()},
+			code:          codes.OK,
+			wantAvailable: 70 * giB,
+		},
+		{
+			name: "uses the datacenter of the topology",
+			setup: func(cloud *fake.Cloud) {
+				cloud.SetQuota(testDcslug, 100)
+				cloud.SetQuota("innoida", 50)
+			},
+			req: &csi.GetCapacityRequest{
+				AccessibleTopology: &csi.Topology{Segments: map[string]string{"region": "innoida"}},
+			},
+			code:          codes.OK,
+			wantAvailable: 50 * giB,
+		},
+		{
+			name: "leaves the capacity of a datacenter without a quota unreported",
+			setup: func(cloud *fake.Cloud) {
+				cloud.SetQuota("innoida", 50)
+			},
+			req:  &csi.GetCapacityRequest{},
+			code: codes.Unimplemented,
+		},
+		{
+			name: "leaves the capacity of an unknown datacenter of the topology unreported",
+			setup: func(cloud *fake.Cloud) {
+				cloud.SetQuota(testDcslug, 100)
+			},
+			req: &csi.GetCapacityRequest{
+				AccessibleTopology: &csi.Topology{Segments: map[string]string{"region": "nowhere"}},
+			},
+			code: codes.Unimplemented,
+		},
+		{
+			name: "leaves the capacity unreported without the quota API",
+			setup: func(cloud *fake.Cloud) {
+				cloud.SetError(fake.OpListQuotas, fake.APIError(http.StatusNotFound, "Not Found"))
+			},
+			req:  &csi.GetCapacityRequest{},
+			code: codes.Unimplemented,
+		},
+		{
+			name: "reports no capacity for unsupported capabilities",
+			setup: func(cloud *fake.Cloud) {
+				cloud.SetQuota(testDcslug, 100)
+			},
+			req: &csi.GetCapacityRequest{
+				VolumeCapabilities: []*csi.VolumeCapability{
+					{
+						AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+						AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY},
+					},
+				},
+			},
+			code:          codes.OK,
+			wantAvailable: 0,
+		},
+		{
+			name: "reports an unavailable API",
+			setup: func(cloud *fake.Cloud) {
+				cloud.SetError(fake.OpListQuotas, fake.APIError(http.StatusServiceUnavailable, "Service Unavailable"))
+			},
+			req:  &csi.GetCapacityRequest{},
+			code: codes.Unavailable,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			controller, cloud := newTestController(t)
+			if tt.setup != nil {
+				tt.setup(cloud)
+			}
+
+			res, err := controller.GetCapacity(context.Background(), tt.req)
+			checkCode(t, err, tt.code)
+			if err != nil {
+				return
+			}
+
+			if res.AvailableCapacity != tt.wantAvailable {
+				t.Errorf("available capacity %d, want %d", res.AvailableCapacity, tt.wantAvailable)
+			}
+		})
+	}
+}
+
+func TestControllerModifyVolume(t *testing.T) {
+	tests := []struct {
+		name           string
+		setup          func(*fake.Cloud)
+		req            *csi.ControllerModifyVolumeRequest
+		code           codes.Code
+		wantIops       string
+		wantThroughput string
+	}{
+		{
+			name: "changes iops and throughput",
+			setup: func(cloud *fake.Cloud) {
+				cloud.AddVolume(testVolume("vol-1", "pvc-1", "16", fake.DetachedCloudID))
+			},
+			req: &csi.ControllerModifyVolumeRequest{
+				VolumeId:          "vol-1",
+				MutableParameters: map[string]string{"iops": "6000", "throughput": "500"},
+			},
+			code:           codes.OK,
+			wantIops:       "6000",
+			wantThroughput: "500",
+		},
+		{
+			name: "leaves the volume alone without parameters",
+			setup: func(cloud *fake.Cloud) {
+				volume := testVolume("vol-1", "pvc-1", "16", fake.DetachedCloudID)
+				volume.Iops = "3000"
+				cloud.AddVolume(volume)
+			},
+			req:      &csi.ControllerModifyVolumeRequest{VolumeId: "vol-1"},
+			code:     codes.OK,
+			wantIops: "3000",
+		},
+		{
+			name: "rejects iops that are not positive",
+			setup: func(cloud *fake.Cloud) {
+				cloud.AddVolume(testVolume("vol-1", "pvc-1", "16", fake.DetachedCloudID))
+			},
+			req: &csi.ControllerModifyVolumeRequest{
+				VolumeId:          "vol-1",
+				MutableParameters: map[string]string{"iops": "-100"},
+			},
+			code: codes.InvalidArgument,
+		},
+		{
+			name: "reports iops Utho refuses for the disk type",
+			setup: func(cloud *fake.Cloud) {
+				cloud.AddVolume(testVolume("vol-1", "pvc-1", "16", fake.DetachedCloudID))
+				cloud.FailOnce(fake.OpResizeVolume, fake.APIError(http.StatusUnprocessableEntity, "iops is out of range for this disk type"))
+			},
+			req: &csi.ControllerModifyVolumeRequest{
+				VolumeId:          "vol-1",
+				MutableParameters: map[string]string{"iops": "100000"},
+			},
+			code: codes.InvalidArgument,
+		},
+		{
+			name: "rejects an unknown parameter",
+			setup: func(cloud *fake.Cloud) {
+				cloud.AddVolume(testVolume("vol-1", "pvc-1", "16", fake.DetachedCloudID))
+			},
+			req: &csi.ControllerModifyVolumeRequest{
+				VolumeId:          "vol-1",
+				MutableParameters: map[string]string{"type": "HDD"},
+			},
+			code: codes.InvalidArgument,
+		},
+		{
+			name: "reports a missing volume",
+			req: &csi.ControllerModifyVolumeRequest{
+				VolumeId:          "vol-1",
+				MutableParameters: map[string]string{"iops": "6000"},
+			},
+			code: codes.NotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			controller, cloud := newTestController(t)
+			if tt.setup != nil {
+				tt.setup(cloud)
+			}
+
+			_, err := controller.ControllerModifyVolume(context.Background(), tt.req)
+			checkCode(t, err, tt.code)
+			if err != nil {
+				return
+			}
+
+			volume, _ := cloud.Volume("vol-1")
+			if volume.Iops != tt.wantIops || volume.Throughput != tt.wantThroughput {
+				t.Errorf("iops %q throughput %q, want %q and %q", volume.Iops, volume.Throughput, tt.wantIops, tt.wantThroughput)
+			}
+			if volume.Size != "16" {
+				t.Errorf("volume size %s GB, want it unchanged at 16 GB", volume.Size)
+			}
+		})
+	}
+}
+
+func TestControllerGetCapabilities(t *testing.T) {
+	controller, _ := newTestController(t)
+
+	res, err := controller.ControllerGetCapabilities(context.Background(), &csi.ControllerGetCapabilitiesRequest{})
+	checkCode(t, err, codes.OK)
+
+	got := map[csi.ControllerServiceCapability_RPC_Type]bool{}
+	for _, capability := range res.Capabilities {
+		got[capability.GetRpc().GetType()] = true
+	}
+
+	tests := []csi.ControllerServiceCapability_RPC_Type{
+		csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+		csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME,
+		csi.ControllerServiceCapability_RPC_LIST_VOLUMES,
+		csi.ControllerServiceCapability_RPC_EXPAND_VOLUME,
+		csi.ControllerServiceCapability_RPC_LIST_VOLUMES_PUBLISHED_NODES,
+		csi.ControllerServiceCapability_RPC_VOLUME_CONDITION,
+		csi.ControllerServiceCapability_RPC_GET_VOLUME,
+		csi.ControllerServiceCapability_RPC_GET_CAPACITY,
+		csi.ControllerServiceCapability_RPC_MODIFY_VOLUME,
+		csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT,
+		csi.ControllerServiceCapability_RPC_LIST_SNAPSHOTS,
+		csi.ControllerServiceCapability_RPC_CLONE_VOLUME,
+	}
+
+	for _, capability := range tests {
+		t.Run(capability.String(), func(t *testing.T) {
+			if !got[capability] {
+				t.Errorf("capability %v is not advertised", capability)
+			}
+		})
+	}
+}
+
+// The spec only lets ListVolumes and ControllerGetVolume report a volume condition
+// when the plugin advertises VOLUME_CONDITION
+func TestVolumeConditionIsAdvertised(t *testing.T) {
+	controller, cloud := newTestController(t)
+	cloud.AddVolume(testVolume("vol-1", "pvc-1", "16", testNodeID))
+
+	getVolume, err := controller.ControllerGetVolume(context.Background(), &csi.ControllerGetVolumeRequest{VolumeId: "vol-1"})
+	checkCode(t, err, codes.OK)
+	listVolumes, err := controller.ListVolumes(context.Background(), &csi.ListVolumesRequest{})
+	checkCode(t, err, codes.OK)
+	if getVolume.Status.VolumeCondition == nil || len(listVolumes.Entries) != 1 || listVolumes.Entries[0].Status.VolumeCondition == nil {
+		t.Fatal("volume condition is not reported")
+	}
+
+	capabilities, err := controller.ControllerGetCapabilities(context.Background(), &csi.ControllerGetCapabilitiesRequest{})
+	checkCode(t, err, codes.OK)
+
+	advertised := map[csi.ControllerServiceCapability_RPC_Type]bool{}
+	for _, capability := range capabilities.Capabilities {
+		advertised[capability.GetRpc().GetType()] = true
+	}
+	for _, capability := range []csi.ControllerServiceCapability_RPC_Type{
+		csi.ControllerServiceCapability_RPC_VOLUME_CONDITION,
+		csi.ControllerServiceCapability_RPC_GET_VOLUME,
+		csi.ControllerServiceCapability_RPC_LIST_VOLUMES_PUBLISHED_NODES,
+	} {
+		if !advertised[capability] {
+			t.Errorf("volume condition is reported without advertising %v", capability)
+		}
+	}
+}
+
+// waitForCall blocks until the cloud got a request for op
+func waitForCall(t *testing.T, cloud *fake.Cloud, op string) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for cloud.Calls(op) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("the cloud got no %s request", op)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestConcurrentOperationsOnAVolumeAreAborted(t *testing.T) {
+	tests := []struct {
+		name string
+		// first is held in the cloud while second runs
+		first  func(*driver.UthoControllerServer) error
+		waitOp string
+		second func(*driver.UthoControllerServer) error
+	}{
+		{
+			name: "create volume",
+			first: func(controller *driver.UthoControllerServer) error {
+				_, err := controller.CreateVolume(context.Background(), &csi.CreateVolumeRequest{Name: "pvc-1", VolumeCapabilities: mountCapabilities()})
+				return err
+			},
+			waitOp: fake.OpListVolumes,
+			second: func(controller *driver.UthoControllerServer) error {
+				_, err := controller.CreateVolume(context.Background(), &csi.CreateVolumeRequest{Name: "pvc-1", VolumeCapabilities: mountCapabilities()})
+				return err
+			},
+		},
+		{
+			name: "delete volume",
+			first: func(controller *driver.UthoControllerServer) error {
+				_, err := controller.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: "vol-1"})
+				return err
+			},
+			waitOp: fake.OpListVolumes,
+			second: func(controller *driver.UthoControllerServer) error {
+				_, err := controller.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: "vol-1"})
+				return err
+			},
+		},
+		{
+			name: "publish during a delete",
+			first: func(controller *driver.UthoControllerServer) error {
+				_, err := controller.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: "vol-1"})
+				return err
+			},
+			waitOp: fake.OpListVolumes,
+			second: func(controller *driver.UthoControllerServer) error {
+				_, err := controller.ControllerPublishVolume(context.Background(), &csi.ControllerPublishVolumeRequest{
+					VolumeId:         "vol-1",
+					NodeId:           testNodeID,
+					VolumeCapability: mountCapabilities()[0],
+				})
+				return err
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			controller, cloud := newTestController(t)
+			cloud.AddVolume(testVolume("vol-1", "pvc-existing", "16", fake.DetachedCloudID))
+			cloud.SetLatency(200 * time.Millisecond)
+
+			first := make(chan error, 1)
+			go func() {
+				first <- tt.first(controller)
+			}()
+			waitForCall(t, cloud, tt.waitOp)
+
+			checkCode(t, tt.second(controller), codes.Aborted)
+			checkCode(t, <-first, codes.OK)
+		})
+	}
+}
+
+func TestOperationsOnANameAndAnIDThatAreEqualDoNotCollide(t *testing.T) {
+	tests := []struct {
+		name   string
+		second func(*driver.UthoControllerServer) error
+	}{
+		{
+			name: "delete the volume with the ID",
+			second: func(controller *driver.UthoControllerServer) error {
+				_, err := controller.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: "vol-1"})
+				return err
+			},
+		},
+		{
+			name: "snapshot named after the ID",
+			second: func(controller *driver.UthoControllerServer) error {
+				_, err := controller.CreateSnapshot(context.Background(), &csi.CreateSnapshotRequest{Name: "vol-1", SourceVolumeId: "vol-2"})
+				return err
+			},
+		},
+		{
+			name: "delete a snapshot with the ID",
+			second: func(controller *driver.UthoControllerServer) error {
+				_, err := controller.DeleteSnapshot(context.Background(), &csi.DeleteSnapshotRequest{SnapshotId: "vol-1"})
+				return err
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			controller, cloud := newTestController(t)
+			cloud.AddVolume(testVolume("vol-1", "pvc-existing", "16", fake.DetachedCloudID))
+			cloud.AddVolume(testVolume("vol-2", "pvc-other", "16", fake.DetachedCloudID))
+			cloud.SetLatency(200 * time.Millisecond)
+
+			// a volume named like the ID of another one
+			first := make(chan error, 1)
+			go func() {
+				_, err := controller.CreateVolume(context.Background(), &csi.CreateVolumeRequest{Name: "vol-1", VolumeCapabilities: mountCapabilities()})
+				first <- err
+			}()
+			waitForCall(t, cloud, fake.OpListVolumes)
+
+			checkCode(t, tt.second(controller), codes.OK)
+			checkCode(t, <-first, codes.OK)
+		})
+	}
+}
+
+func TestStorageCallsAreBoundToTheRPCContext(t *testing.T) {
+	controller, cloud := newTestController(t)
+	volumeID := cloud.AddVolume(testVolume("", "pvc-1", "16", fake.DetachedCloudID))
+	cloud.SetLatency(time.Minute)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err := controller.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: volumeID})
+	checkCode(t, err, codes.DeadlineExceeded)
+
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("DeleteVolume returned after %v, the storage call outlived the RPC", elapsed)
+	}
+}
+
+func TestCreateVolumeRetryDoesNotJoinAStaleListing(t *testing.T) {
+	const latency = 200 * time.Millisecond
+
+	controller, cloud := newTestController(t)
+	cloud.SetLatency(latency)
+
+	listVolumes := func() {
+		_, _ = controller.ListVolumes(context.Background(), &csi.ListVolumesRequest{})
+	}
+
+	req := &csi.CreateVolumeRequest{Name: "pvc-1", VolumeCapabilities: mountCapabilities()}
+
+	// a listing is in flight when the first call starts, so it joins it
+	go listVolumes()
+	time.Sleep(latency / 4)
+
+	// another listing starts while the volume is being created and is still running
+	// when the retry comes in
+	go func() {
+		time.Sleep(latency + latency/4)
+		listVolumes()
+	}()
+
+	first, err := controller.CreateVolume(context.Background(), req)
+	checkCode(t, err, codes.OK)
+
+	retry, err := controller.CreateVolume(context.Background(), req)
+	checkCode(t, err, codes.OK)
+
+	if first.Volume.VolumeId != retry.Volume.VolumeId {
+		t.Errorf("retry returned volume %s, want %s", retry.Volume.VolumeId, first.Volume.VolumeId)
+	}
+	if calls := cloud.Calls(fake.OpCreateVolume); calls != 1 {
+		t.Errorf("volume was created %d times, want once", calls)
+	}
+}
@@ -0,0 +1,234 @@
+package driver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+const (
+	sysBlockPath = "/sys/block"
+	devPath      = "/dev"
+
+	// serialPrefix is the serial Utho gives the virtio disk of a volume, followed by the volume ID
+	serialPrefix = "uthostorage-"
+
+	// virtio truncates disk serials to 20 characters, and udev names the by-id link after the serial
+	virtioSerialMaxLen = 20
+
+	// sectorSize is the unit of /sys/block/<dev>/size
+	sectorSize = 512
+
+	deviceResolveTimeout  = 30 * time.Second
+	deviceResolveInterval = 500 * time.Millisecond
+)
+
+// errDeviceNotReady means the device was found but isn't usable yet, resolving keeps waiting
+var errDeviceNotReady = errors.New("device is not ready")
+
+// deviceResolver finds the block device of an attached volume. The disk may show up
+// some time after ControllerPublishVolume returns, and its udev link may be missing
+// or named after a truncated serial, so it waits and falls back to sysfs
+type deviceResolver struct {
+	byIDPath string
+	sysPath  string
+	devPath  string
+	timeout  time.Duration
+	interval time.Duration
+}
+
+func newDeviceResolver() *deviceResolver {
+	return &deviceResolver{
+		byIDPath: diskPath,
+		sysPath:  sysBlockPath,
+		devPath:  devPath,
+		timeout:  deviceResolveTimeout,
+		interval: deviceResolveInterval,
+	}
+}
+
+// resolve waits for the device of the volume to appear and returns its path. It returns
+// Unavailable when the device doesn't appear in time so the CO retries the call
+func (r *deviceResolver) resolve(ctx context.Context, volumeID string) (string, error) {
+	var device string
+	var lastErr error
+
+	err := wait.PollUntilContextTimeout(ctx, r.interval, r.timeout, true, func(context.Context) (bool, error) {
+		device, lastErr = r.find(volumeID)
+		switch {
+		case lastErr == nil:
+			return true, nil
+		case errors.Is(lastErr, os.ErrNotExist), errors.Is(lastErr, errDeviceNotReady):
+			return false, nil
+		default:
+			return false, lastErr
+		}
+	})
+	if err == nil {
+		return device, nil
+	}
+
+	if wait.Interrupted(err) {
+		reason := "it did not appear"
+		if lastErr != nil && !errors.Is(lastErr, os.ErrNotExist) {
+			reason = lastErr.Error()
+		}
+		return "", status.Errorf(codes.Unavailable, "timed out after %v waiting for the device of volume %s under %s or with serial %q in %s: %s",
+			r.timeout, volumeID, r.byIDPath, serialPrefix+volumeID, r.sysPath, reason)
+	}
+
+	return "", status.Errorf(codes.Internal, "cannot find the device of volume %s: %v", volumeID, err)
+}
+
+// find looks the device of the volume up once, through its udev link first and sysfs
+// serials second. It returns os.ErrNotExist when the device isn't there yet
+func (r *deviceResolver) find(volumeID string) (string, error) {
+	serial := serialPrefix + volumeID
+
+	for _, name := range byIDNames(serial) {
+		link := filepath.Join(r.byIDPath, name)
+		target, err := filepath.EvalSymlinks(link)
+		if err != nil {
+			continue
+		}
+
+		if err := r.checkSize(filepath.Base(target)); err != nil {
+			return "", fmt.Errorf("%s: %w", link, err)
+		}
+		return link, nil
+	}
+
+	name, err := r.findBySerial(serial)
+	if err != nil {
+		return "", err
+	}
+
+	if err := r.checkSize(name); err != nil {
+		return "", fmt.Errorf("%s: %w", name, err)
+	}
+	return filepath.Join(r.devPath, name), nil
+}
+
+// findBySerial scans the serial of every block device for the one of the volume
+func (r *deviceResolver) findBySerial(serial string) (string, error) {
+	entries, err := os.ReadDir(r.sysPath)
+	if err != nil {
+		return "", err
+	}
+
+	for _, entry := range entries {
+		data, err := os.ReadFile(filepath.Join(r.sysPath, entry.Name(), "serial"))
+		if err != nil {
+			continue
+		}
+
+		if serialMatches(strings.TrimSpace(string(data)), serial) {
+			return entry.Name(), nil
+		}
+	}
+
+	return "", os.ErrNotExist
+}
+
+// checkSize makes sure the device has a size a Utho volume can have, a device
+// that reports no size yet is still being set up
+func (r *deviceResolver) checkSize(name string) error {
+	data, err := os.ReadFile(filepath.Join(r.sysPath, name, "size"))
+	if err != nil {
+		// not every device exposes its size, don't hold it against it
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+
+	sectors, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid size %q: %v", strings.TrimSpace(string(data)), err)
+	}
+
+	size := sectors * sectorSize
+	switch {
+	case size == 0:
+		return errDeviceNotReady
+	case size < minimumVolumeSizeInBytes, size > maximumVolumeSizeInBytes:
+		return fmt.Errorf("device size %v is outside of the volume size range (%v-%v)",
+			formatBytes(size), formatBytes(minimumVolumeSizeInBytes), formatBytes(maximumVolumeSizeInBytes))
+	}
+
+	return nil
+}
+
+// byIDNames returns the names udev may give the link of a disk with the serial,
+// the full one and the one of the truncated serial
+func byIDNames(serial string) []string {
+	names := []string{"virtio-" + serial}
+	if len(serial) > virtioSerialMaxLen {
+		names = append(names, "virtio-"+serial[:virtioSerialMaxLen])
+	}
+	return names
+}
+
+// serialMatches reports whether a device serial is the serial of the volume. A serial
+// cut at the virtio limit only has the start of it, shorter serials must match exactly
+// or the device of volume 12 would be taken for volume 123
+func serialMatches(deviceSerial, serial string) bool {
+	if deviceSerial == serial {
+		return true
+	}
+
+	return len(deviceSerial) == virtioSerialMaxLen && strings.HasPrefix(serial, deviceSerial)
+}
+
+// verifySerial checks that the device really is the disk of the volume, so a stale
+// link or a wrong attachment can't get another volume formatted
+func (r *deviceResolver) verifySerial(device, volumeID string) error {
+	resolved, err := filepath.EvalSymlinks(device)
+	if err != nil {
+		return status.Errorf(codes.Internal, "cannot resolve device %s: %v", device, err)
+	}
+
+	name := filepath.Base(resolved)
+	data, err := os.ReadFile(filepath.Join(r.sysPath, name, "serial"))
+	if err != nil {
+		return status.Errorf(codes.FailedPrecondition, "cannot read the serial of device %s to confirm it belongs to volume %s: %v", resolved, volumeID, err)
+	}
+
+	deviceSerial := strings.TrimSpace(string(data))
+	if !serialMatches(deviceSerial, serialPrefix+volumeID) {
+		return status.Errorf(codes.FailedPrecondition, "device %s has serial %q, it is not the disk of volume %s", resolved, deviceSerial, volumeID)
+	}
+
+	return nil
+}
+
+// holders returns the devices built on top of the device, e.g. device mapper targets
+func (r *deviceResolver) holders(device string) ([]string, error) {
+	resolved, err := filepath.EvalSymlinks(device)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(filepath.Join(r.sysPath, filepath.Base(resolved), "holders"))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	holders := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		holders = append(holders, entry.Name())
+	}
+	return holders, nil
+}
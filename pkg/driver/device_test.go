@@ -0,0 +1,128 @@
+package driver
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+)
+
+func TestDeviceResolverResolve(t *testing.T) {
+	tests := []struct {
+		name     string
+		setup    func(*testing.T, *testNode) string
+		volumeID string
+		code     codes.Code
+	}{
+		{
+			name: "finds the disk through its udev link",
+			setup: func(t *testing.T, node *testNode) string {
+				return node.addDisk(t, "vdb", "1234", giB)
+			},
+			volumeID: "1234",
+			code:     codes.OK,
+		},
+		{
+			name: "finds the disk through the link of its truncated serial",
+			setup: func(t *testing.T, node *testNode) string {
+				return node.addDisk(t, "vdb", "1234567890abc", giB)
+			},
+			volumeID: "1234567890abc",
+			code:     codes.OK,
+		},
+		{
+			name: "falls back to the sysfs serial without a udev link",
+			setup: func(t *testing.T, node *testNode) string {
+				node.addDevice(t, "vdc", serialPrefix+"1234", giB)
+				return filepath.Join(node.dir, "dev", "vdc")
+			},
+			volumeID: "1234",
+			code:     codes.OK,
+		},
+		{
+			name: "matches a sysfs serial truncated by virtio",
+			setup: func(t *testing.T, node *testNode) string {
+				node.addDevice(t, "vdc", (serialPrefix + "1234567890abc")[:virtioSerialMaxLen], giB)
+				return filepath.Join(node.dir, "dev", "vdc")
+			},
+			volumeID: "1234567890abc",
+			code:     codes.OK,
+		},
+		{
+			name: "does not take the disk of volume 123 for volume 12",
+			setup: func(t *testing.T, node *testNode) string {
+				node.addDevice(t, "vdb", serialPrefix+"123", giB)
+				return ""
+			},
+			volumeID: "12",
+			code:     codes.Unavailable,
+		},
+		{
+			name: "does not match a short serial by prefix",
+			setup: func(t *testing.T, node *testNode) string {
+				node.addDevice(t, "vdb", (serialPrefix + "1234567890abc")[:virtioSerialMaxLen-1], giB)
+				return ""
+			},
+			volumeID: "1234567890abc",
+			code:     codes.Unavailable,
+		},
+		{
+			name: "rejects a disk too small to be a volume",
+			setup: func(t *testing.T, node *testNode) string {
+				node.addDisk(t, "vdb", "1234", 512*1024*1024)
+				return ""
+			},
+			volumeID: "1234",
+			code:     codes.Internal,
+		},
+		{
+			name: "waits for a disk that reports no size yet",
+			setup: func(t *testing.T, node *testNode) string {
+				node.addDisk(t, "vdb", "1234", 0)
+				return ""
+			},
+			volumeID: "1234",
+			code:     codes.Unavailable,
+		},
+		{
+			name:     "times out when the disk does not appear",
+			setup:    func(*testing.T, *testNode) string { return "" },
+			volumeID: "1234",
+			code:     codes.Unavailable,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			node := newTestNode(t)
+			want := tt.setup(t, node)
+
+			device, err := node.devices.resolve(context.Background(), tt.volumeID)
+			checkCode(t, err, tt.code)
+			if device != want {
+				t.Errorf("resolved device %q, want %q", device, want)
+			}
+		})
+	}
+}
+
+func TestDeviceResolverWaitsForTheDisk(t *testing.T) {
+	node := newTestNode(t)
+	node.devices.timeout = 5 * time.Second
+
+	found := make(chan error, 1)
+	go func() {
+		_, err := node.devices.resolve(context.Background(), "1234")
+		found <- err
+	}()
+
+	// the disk shows up after a few lookups missed it
+	time.Sleep(3 * node.devices.interval)
+	node.addDisk(t, "vdb", "1234", giB)
+
+	if err := <-found; err != nil {
+		t.Fatalf("disk was not found once it appeared: %v", err)
+	}
+}
@@ -5,7 +5,6 @@ import (
 	"time"
 
 	"github.com/sirupsen/logrus"
-	"github.com/uthoplatforms/utho-go/utho"
 	"k8s.io/mount-utils"
 	"k8s.io/utils/exec"
 )
@@ -22,9 +21,15 @@ type UthoDriver struct {
 	endpoint        string
 	nodeID          string
 	dcslug          string
-	client          utho.Client
+	clusterID       string
+	client          *apiClient
+	storage         BlockStorage
+	clusters        Clusters
 
 	publishInfoVolumeName string
+	adoptForeignVolumes   bool
+	volumeLocks           *volumeLocks
+	volumeCache           *volumeCache
 	mounter               *mount.SafeFormatAndMount
 	resizer               *mount.ResizeFs
 
@@ -36,54 +41,69 @@ type UthoDriver struct {
 	version string
 }
 
-func NewDriver(endpoint, token, driverName, version, dcslug string, isDebug bool) (*UthoDriver, error) {
-	if driverName == "" {
-		driverName = DefaultDriverName
-	}
+// DriverOption customizes the UthoDriver built by NewDriver
+type DriverOption func(*UthoDriver)
 
-	client, err := utho.NewClient(token)
-	if err != nil {
-		return nil, err
+// WithAdoptForeignVolumes lets the driver change volumes that were not created by
+// this cluster, e.g. volumes created by hand or by another cluster sharing the token
+func WithAdoptForeignVolumes(adopt bool) DriverOption {
+	return func(d *UthoDriver) {
+		d.adoptForeignVolumes = adopt
 	}
+}
 
-	log := logrus.New().WithFields(logrus.Fields{
-		"version": version,
-	})
+// WithClusterID scopes the volumes the driver owns to the cluster id, instead of the
+// one read from the node labels
+func WithClusterID(clusterID string) DriverOption {
+	return func(d *UthoDriver) {
+		d.clusterID = clusterID
+	}
+}
 
-	var nodeId string
+// WithVolumeCacheTTL sets how long a listing of the account's volumes is reused, 0 disables the cache
+func WithVolumeCacheTTL(ttl time.Duration) DriverOption {
+	return func(d *UthoDriver) {
+		d.volumeCache.ttl = ttl
+	}
+}
 
-	if isDebug {
-		nodeId = GenerateRandomString(10)
-	} else {
-		nodeId, err = GetNodeId(client)
-		if err != nil {
-			return nil, err
-		}
+// WithBlockStorage makes the controller manage volumes through storage instead of the
+// Utho API, e.g. to run it against a fake in tests
+func WithBlockStorage(storage BlockStorage) DriverOption {
+	return func(d *UthoDriver) {
+		d.storage = storage
+	}
+}
 
-		clusterId, err := GetClusterID()
-		if err != nil {
-			return nil, err
-		}
+// WithClusters makes the driver look up its node and cluster through clusters instead of
+// the Utho API, e.g. to run it against a fake in tests
+func WithClusters(clusters Clusters) DriverOption {
+	return func(d *UthoDriver) {
+		d.clusters = clusters
+	}
+}
 
-		dcslug, err = GetDcslug(client, clusterId)
-		if err != nil {
-			return nil, err
-		}
+func NewDriver(endpoint, token, driverName, version, dcslug string, isDebug bool, opts ...DriverOption) (*UthoDriver, error) {
+	if driverName == "" {
+		driverName = DefaultDriverName
 	}
-	fmt.Printf("node id %s:\n", nodeId)
 
-	return &UthoDriver{
+	log := logrus.New().WithFields(logrus.Fields{
+		"version": version,
+	})
+
+	d := &UthoDriver{
 		name:                  driverName,
 		publishInfoVolumeName: driverName + "/volume-name",
 
 		endpoint: endpoint,
-		nodeID:   nodeId,
 		dcslug:   dcslug,
-		client:   client,
 
-		log: log,
+		log:         log,
+		volumeLocks: newVolumeLocks(),
+		volumeCache: newVolumeCache(defaultVolumeCacheTTL),
 		mounter: &mount.SafeFormatAndMount{
-			Interface: mount.New(""),
+			Interface: newProcMounter(),
 			Exec:      exec.New(),
 		},
 
@@ -93,7 +113,61 @@ func NewDriver(endpoint, token, driverName, version, dcslug string, isDebug bool
 		}.Exec),
 
 		version: version,
-	}, nil
+	}
+
+	for _, opt := range opts {
+		opt(d)
+	}
+
+	// the Utho API is still needed to find the node and cluster when the
+	// block storage is provided by the caller, unless running in debug mode
+	if d.storage == nil || (d.clusters == nil && !isDebug) {
+		client, err := newAPIClient(token)
+		if err != nil {
+			return nil, err
+		}
+		d.client = client
+	}
+
+	if d.storage == nil {
+		d.storage = newUthoBlockStorage(d.client)
+	}
+	if d.clusters == nil && d.client != nil {
+		d.clusters = newUthoClusters(d.client)
+	}
+
+	var err error
+	if isDebug {
+		d.nodeID = GenerateRandomString(10)
+
+		// the datacenter can still be looked up when a cluster is given, e.g. a fake one
+		if d.dcslug == "" && d.clusterID != "" && d.clusters != nil {
+			d.dcslug, err = GetDcslug(d.clusters, d.clusterID)
+			if err != nil {
+				return nil, err
+			}
+		}
+	} else {
+		d.nodeID, err = GetNodeId(d.clusters)
+		if err != nil {
+			return nil, err
+		}
+
+		if d.clusterID == "" {
+			d.clusterID, err = GetClusterID()
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		d.dcslug, err = GetDcslug(d.clusters, d.clusterID)
+		if err != nil {
+			return nil, err
+		}
+	}
+	fmt.Printf("node id %s:\n", d.nodeID)
+
+	return d, nil
 }
 
 func (d *UthoDriver) Run() {
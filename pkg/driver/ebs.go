@@ -0,0 +1,301 @@
+package driver
+
+import (
+	"context"
+
+	"github.com/uthoplatforms/utho-go/utho"
+)
+
+// The calls below cover the Utho EBS API the driver uses. utho-go sends its
+// requests without a context and doesn't expose every call, so they build
+// requests with the client's own NewRequest/Do, which keeps auth and error
+// handling the same as the rest of the library, bound to the caller's context.
+
+type ebsVolumes struct {
+	Ebs     []Volume `json:"ebs"`
+	Status  string   `json:"status"`
+	Message string   `json:"message"`
+}
+
+// Volume is an EBS volume as the Utho API returns it, with its snapshots
+type Volume struct {
+	utho.Ebs
+	Snapshots []Snapshot `json:"snapshots,omitempty"`
+}
+
+// listEBS returns every EBS volume in the account
+func listEBS(ctx context.Context, client utho.Client) ([]Volume, error) {
+	reqUrl := "ebs"
+	req, err := client.NewRequest("GET", reqUrl)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+
+	var res ebsVolumes
+	if _, err := client.Do(req, &res); err != nil {
+		return nil, err
+	}
+	if res.Status != "success" && res.Status != "" {
+		return nil, &UthoError{Message: res.Message}
+	}
+
+	return res.Ebs, nil
+}
+
+// readEBS returns the EBS volume
+func readEBS(ctx context.Context, client utho.Client, ebsId string) (*Volume, error) {
+	reqUrl := "ebs/" + ebsId
+	req, err := client.NewRequest("GET", reqUrl)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+
+	var res ebsVolumes
+	if _, err := client.Do(req, &res); err != nil {
+		return nil, err
+	}
+	if res.Status != "success" && res.Status != "" {
+		return nil, &UthoError{Message: res.Message}
+	}
+	if len(res.Ebs) == 0 {
+		return nil, &UthoError{Message: "NotFound"}
+	}
+
+	return &res.Ebs[0], nil
+}
+
+// CreateVolumeParams describes a new EBS volume, restored from SnapshotID when it is set.
+// utho-go's CreateEBSParams has no snapshot, the field is named after the snapshotid of
+// its CreateCloudInstanceParams, which restores a cloud server from a snapshot
+type CreateVolumeParams struct {
+	utho.CreateEBSParams
+	SnapshotID string `json:"snapshotid,omitempty"`
+}
+
+// createEBS creates an EBS volume, restoring it from a snapshot when one is set
+func createEBS(ctx context.Context, client utho.Client, params CreateVolumeParams) (*utho.CreateResponse, error) {
+	reqUrl := "ebs"
+	req, err := client.NewRequest("POST", reqUrl, &params)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+
+	var res utho.CreateResponse
+	if _, err := client.Do(req, &res); err != nil {
+		return nil, err
+	}
+	if res.Status != "success" && res.Status != "" {
+		return nil, &UthoError{Message: res.Message}
+	}
+
+	return &res, nil
+}
+
+// ResizeVolumeParams sets the size in GB, iops and throughput of an EBS volume at once.
+// It is utho-go's ResizeEBSParams, which the versions of the library that have the call
+// (v0.2 and later) send as PUT ebs/{id}/resize
+type ResizeVolumeParams struct {
+	Disk       string `json:"disk"`
+	Iops       string `json:"iops"`
+	Throughput string `json:"throughput"`
+}
+
+// resizeEBS changes the size and performance of the EBS volume
+func resizeEBS(ctx context.Context, client utho.Client, ebsId string, params ResizeVolumeParams) error {
+	reqUrl := "ebs/" + ebsId + "/resize"
+	req, err := client.NewRequest("PUT", reqUrl, &params)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+
+	var res utho.UpdateResponse
+	if _, err := client.Do(req, &res); err != nil {
+		return err
+	}
+	if res.Status != "success" && res.Status != "" {
+		return &UthoError{Message: res.Message}
+	}
+
+	return nil
+}
+
+// utho-go has no EBS snapshot calls. The ones below follow its cloud server snapshot calls
+// (CloudInstancesService.CreateSnapshot, DeleteSnapshot and the snapshots listed with the
+// server): POST {resource}/snapshot/create with a name, DELETE {resource}/snapshot/{id}/delete,
+// and the snapshots of a volume read with it. ebs_test.go pins what goes on the wire
+
+// Snapshot is an EBS snapshot, Size is in GB. EbsID is not part of the API response, it is
+// set to the volume the snapshot was listed with
+type Snapshot struct {
+	ID        string `json:"id"`
+	EbsID     string `json:"-"`
+	Name      string `json:"name"`
+	Size      string `json:"size"`
+	Status    string `json:"status"`
+	CreatedAt string `json:"created_at"`
+}
+
+type createEBSSnapshotParams struct {
+	Name string `json:"name"`
+}
+
+// createEBSSnapshot takes a snapshot of the EBS volume
+func createEBSSnapshot(ctx context.Context, client utho.Client, ebsId string, params createEBSSnapshotParams) (*utho.CreateResponse, error) {
+	reqUrl := "ebs/" + ebsId + "/snapshot/create"
+	req, err := client.NewRequest("POST", reqUrl, &params)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+
+	var res utho.CreateResponse
+	if _, err := client.Do(req, &res); err != nil {
+		return nil, err
+	}
+	if res.Status != "success" && res.Status != "" {
+		return nil, &UthoError{Message: res.Message}
+	}
+
+	return &res, nil
+}
+
+// listEBSSnapshots returns every EBS snapshot in the account, from the volumes they were taken of
+func listEBSSnapshots(ctx context.Context, client utho.Client) ([]Snapshot, error) {
+	volumes, err := listEBS(ctx, client)
+	if err != nil {
+		return nil, err
+	}
+
+	var snapshots []Snapshot
+	for _, volume := range volumes {
+		for _, snapshot := range volume.Snapshots {
+			snapshot.EbsID = volume.ID
+			snapshots = append(snapshots, snapshot)
+		}
+	}
+
+	return snapshots, nil
+}
+
+// deleteEBSSnapshot removes the snapshot of the EBS volume
+func deleteEBSSnapshot(ctx context.Context, client utho.Client, ebsId, snapshotId string) error {
+	reqUrl := "ebs/" + ebsId + "/snapshot/" + snapshotId + "/delete"
+	req, err := client.NewRequest("DELETE", reqUrl)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+
+	var res utho.DeleteResponse
+	if _, err := client.Do(req, &res); err != nil {
+		return err
+	}
+	if res.Status != "success" && res.Status != "" {
+		return &UthoError{Message: res.Message}
+	}
+
+	return nil
+}
+
+type ebsQuotas struct {
+	Quotas  []Quota `json:"quota"`
+	Status  string  `json:"status"`
+	Message string  `json:"message"`
+}
+
+// Quota is the block storage allowance of the account in one datacenter, in GB
+type Quota struct {
+	Dcslug string `json:"dcslug"`
+	Limit  string `json:"limit"`
+	Used   string `json:"used"`
+}
+
+// listEBSQuotas returns the block storage quota of the account per datacenter. utho-go
+// has no call for it, accounts without the endpoint get a 404
+func listEBSQuotas(ctx context.Context, client utho.Client) ([]Quota, error) {
+	reqUrl := "ebs/quota"
+	req, err := client.NewRequest("GET", reqUrl)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+
+	var res ebsQuotas
+	if _, err := client.Do(req, &res); err != nil {
+		return nil, err
+	}
+	if res.Status != "success" && res.Status != "" {
+		return nil, &UthoError{Message: res.Message}
+	}
+
+	return res.Quotas, nil
+}
+
+// deleteEBS removes the EBS volume
+func deleteEBS(ctx context.Context, client utho.Client, ebsId string) error {
+	reqUrl := "ebs/" + ebsId + "/destroy"
+	req, err := client.NewRequest("DELETE", reqUrl)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+
+	var res utho.DeleteResponse
+	if _, err := client.Do(req, &res); err != nil {
+		return err
+	}
+	if res.Status != "success" && res.Status != "" {
+		return &UthoError{Message: res.Message}
+	}
+
+	return nil
+}
+
+type attachEBSParams struct {
+	ResourceID string `json:"resourceid"`
+	Type       string `json:"type"`
+}
+
+// attachEBS attaches the EBS volume to a cloud server
+func attachEBS(ctx context.Context, client utho.Client, ebsId string, params attachEBSParams) error {
+	reqUrl := "ebs/" + ebsId + "/attach"
+	req, err := client.NewRequest("POST", reqUrl, &params)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+
+	var res utho.CreateResponse
+	if _, err := client.Do(req, &res); err != nil {
+		return err
+	}
+	if res.Status != "success" && res.Status != "" {
+		return &UthoError{Message: res.Message}
+	}
+
+	return nil
+}
+
+// detachEBS detaches the EBS volume from a cloud server, the API spells it dettach
+func detachEBS(ctx context.Context, client utho.Client, ebsId string, params attachEBSParams) error {
+	reqUrl := "ebs/" + ebsId + "/dettach"
+	req, err := client.NewRequest("POST", reqUrl, &params)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+
+	var res utho.CreateResponse
+	if _, err := client.Do(req, &res); err != nil {
+		return err
+	}
+	if res.Status != "success" && res.Status != "" {
+		return &UthoError{Message: res.Message}
+	}
+
+	return nil
+}
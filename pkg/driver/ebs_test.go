@@ -0,0 +1,243 @@
+package driver
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/uthoplatforms/utho-go/utho"
+)
+
+// Responses recorded by utho-go for the EBS API
+const (
+	recordedEbs = `{
+	"did": "11111",
+	"cloudid": "22222",
+	"primaryd": "0",
+	"size": "30.000",
+	"status": "Active",
+	"extrabill": "0",
+	"created_at": "2024-09-22 19:14:33",
+	"deleted_at": "0000-00-00 00:00:00",
+	"ebs": "1",
+	"name": "testee",
+	"iops": "3000",
+	"throughput": "125",
+	"location": {
+		"city": "Mumbai",
+		"country": "India",
+		"dc": "inmumbaizone2",
+		"dccc": "in"
+	}
+}`
+
+	recordedCreateResponse = `{
+	"id": "111",
+	"status": "success",
+	"message": "success"
+}`
+
+	recordedUpdateResponse = `{
+	"id": "111",
+	"status": "success",
+	"message": "success"
+}`
+)
+
+// apiRequest is a request received by the test API server
+type apiRequest struct {
+	method string
+	path   string
+	body   map[string]interface{}
+}
+
+// newTestStorage returns a uthoBlockStorage talking to a server that answers every
+// request with response, and the requests the server received
+func newTestStorage(t *testing.T, response string) (*uthoBlockStorage, *[]apiRequest) {
+	t.Helper()
+
+	var requests []apiRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := apiRequest{method: r.Method, path: r.URL.Path}
+		if r.ContentLength > 0 {
+			if err := json.NewDecoder(r.Body).Decode(&req.body); err != nil {
+				t.Errorf("cannot decode %s %s body: %v", r.Method, r.URL.Path, err)
+			}
+		}
+		requests = append(requests, req)
+
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(response))
+	}))
+	t.Cleanup(server.Close)
+
+	client, err := utho.NewClient("token", utho.WithBaseURL(server.URL+"/"))
+	if err != nil {
+		t.Fatalf("cannot create client: %v", err)
+	}
+
+	return newUthoBlockStorage(client), &requests
+}
+
+// checkRequest checks the one request the server received, and that its body has exactly the given fields
+func checkRequest(t *testing.T, requests []apiRequest, method, path string, fields map[string]interface{}) {
+	t.Helper()
+
+	if len(requests) != 1 {
+		t.Fatalf("got %d requests, want 1", len(requests))
+	}
+
+	req := requests[0]
+	if req.method != method || req.path != path {
+		t.Errorf("got request %s %s, want %s %s", req.method, req.path, method, path)
+	}
+	if len(req.body) != len(fields) {
+		t.Errorf("got body %v, want %v", req.body, fields)
+	}
+	for key, want := range fields {
+		if got, ok := req.body[key]; !ok || got != want {
+			t.Errorf("body field %q is %v, want %v", key, got, want)
+		}
+	}
+}
+
+func TestUthoBlockStorageCreateVolume(t *testing.T) {
+	storage, requests := newTestStorage(t, recordedCreateResponse)
+
+	id, err := storage.CreateVolume(context.Background(), CreateVolumeParams{
+		CreateEBSParams: utho.CreateEBSParams{
+			Name:       "csi-cluster-1-pvc-1-default-data",
+			Dcslug:     "inmumbaizone2",
+			Disk:       "30",
+			Iops:       "3000",
+			Throughput: "125",
+			DiskType:   "SSD",
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if id != "111" {
+		t.Errorf("got volume id %q, want 111", id)
+	}
+
+	checkRequest(t, *requests, http.MethodPost, "/ebs", map[string]interface{}{
+		"name":       "csi-cluster-1-pvc-1-default-data",
+		"dcslug":     "inmumbaizone2",
+		"disk":       "30",
+		"iops":       "3000",
+		"throughput": "125",
+		"disk_type":  "SSD",
+	})
+}
+
+func TestUthoBlockStorageCreateVolumeFromSnapshot(t *testing.T) {
+	storage, requests := newTestStorage(t, recordedCreateResponse)
+
+	_, err := storage.CreateVolume(context.Background(), CreateVolumeParams{
+		CreateEBSParams: utho.CreateEBSParams{
+			Name:       "csi-cluster-1-pvc-1-default-data",
+			Dcslug:     "inmumbaizone2",
+			Disk:       "30",
+			Iops:       "3000",
+			Throughput: "125",
+			DiskType:   "SSD",
+		},
+		SnapshotID: "33333",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	checkRequest(t, *requests, http.MethodPost, "/ebs", map[string]interface{}{
+		"name":       "csi-cluster-1-pvc-1-default-data",
+		"dcslug":     "inmumbaizone2",
+		"disk":       "30",
+		"iops":       "3000",
+		"throughput": "125",
+		"disk_type":  "SSD",
+		"snapshotid": "33333",
+	})
+}
+
+func TestUthoBlockStorageGetVolume(t *testing.T) {
+	storage, requests := newTestStorage(t, `{"ebs": [`+recordedEbs+`]}`)
+
+	volume, err := storage.GetVolume(context.Background(), "11111")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	checkRequest(t, *requests, http.MethodGet, "/ebs/11111", nil)
+
+	if volume.ID != "11111" || volume.Cloudid != "22222" || volume.Name != "testee" || volume.Size != "30.000" || volume.Location.Dc != "inmumbaizone2" {
+		t.Errorf("unexpected volume %+v", volume)
+	}
+	if size, err := ebsSizeInBytes(volume.Size); err != nil || size != 30*giB {
+		t.Errorf("got size %d (%v), want %d", size, err, 30*giB)
+	}
+}
+
+func TestUthoBlockStorageResizeVolume(t *testing.T) {
+	storage, requests := newTestStorage(t, recordedUpdateResponse)
+
+	err := storage.ResizeVolume(context.Background(), "11111", ResizeVolumeParams{
+		Disk:       "40",
+		Iops:       "3000",
+		Throughput: "125",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	checkRequest(t, *requests, http.MethodPut, "/ebs/11111/resize", map[string]interface{}{
+		"disk":       "40",
+		"iops":       "3000",
+		"throughput": "125",
+	})
+}
+
+func TestUthoBlockStorageCreateSnapshot(t *testing.T) {
+	storage, requests := newTestStorage(t, recordedCreateResponse)
+
+	id, err := storage.CreateSnapshot(context.Background(), "11111", "snapshot-1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if id != "111" {
+		t.Errorf("got snapshot id %q, want 111", id)
+	}
+
+	checkRequest(t, *requests, http.MethodPost, "/ebs/11111/snapshot/create", map[string]interface{}{
+		"name": "snapshot-1",
+	})
+}
+
+func TestUthoBlockStorageListSnapshots(t *testing.T) {
+	snapshot := `{"id": "33333", "name": "snapshot-1", "size": "30", "status": "Active", "created_at": "2024-09-23 10:00:00"}`
+	volume := strings.TrimSuffix(recordedEbs, "}") + `, "snapshots": [` + snapshot + `]}`
+	storage, requests := newTestStorage(t, `{"ebs": [`+volume+`]}`)
+
+	snapshots, err := storage.ListSnapshots(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	checkRequest(t, *requests, http.MethodGet, "/ebs", nil)
+
+	want := Snapshot{ID: "33333", EbsID: "11111", Name: "snapshot-1", Size: "30", Status: "Active", CreatedAt: "2024-09-23 10:00:00"}
+	if len(snapshots) != 1 || snapshots[0] != want {
+		t.Errorf("got snapshots %+v, want [%+v]", snapshots, want)
+	}
+}
+
+func TestUthoBlockStorageDeleteSnapshot(t *testing.T) {
+	storage, requests := newTestStorage(t, `{"status": "success", "message": "success"}`)
+
+	if err := storage.DeleteSnapshot(context.Background(), "11111", "33333"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	checkRequest(t, *requests, http.MethodDelete, "/ebs/11111/snapshot/33333/delete", nil)
+}
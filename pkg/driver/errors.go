@@ -0,0 +1,198 @@
+package driver
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/uthoplatforms/utho-go/utho"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// uthoErrorKind is the class of failure behind an error returned by the Utho API
+type uthoErrorKind int
+
+const (
+	uthoErrUnknown uthoErrorKind = iota
+	uthoErrNotFound
+	uthoErrNotAttached
+	uthoErrAttached
+	uthoErrQuota
+	uthoErrRateLimited
+	uthoErrUnavailable
+	uthoErrAuth
+	uthoErrValidation
+	uthoErrTimeout
+)
+
+// Fragments of the messages Utho returns with a "status": "error" body. The API
+// answers most failures with 200 and a message, so the message is often all there is
+var (
+	notAttachedMessages = []string{"not currently attached"}
+	attachedMessages    = []string{"is attached", "detach it first", "still attached"}
+	notFoundMessages    = []string{"notfound", "not found", "does not exist", "doesn't exist", "no such"}
+	quotaMessages       = []string{"quota", "limit exceeded", "insufficient balance", "insufficient credit", "insufficient fund"}
+	rateLimitMessages   = []string{"rate limit", "too many requests"}
+	authMessages        = []string{"unauthorized", "unauthenticated", "invalid api key", "invalid token", "authentication"}
+	validationMessages  = []string{"invalid", "required", "must be", "should be"}
+)
+
+// UthoError is a failure the Utho API reported in the message of a "status": "error"
+// response, which it answers most failures with
+type UthoError struct {
+	Message string
+}
+
+func (e *UthoError) Error() string {
+	return e.Message
+}
+
+// classifyUthoError works out what kind of failure err is, from the HTTP status of the
+// response when utho-go returns one and from the message of an API answer otherwise.
+// Messages are only trusted when the API sent them, any other failure, e.g. a body that
+// isn't JSON, is unknown
+func classifyUthoError(err error) uthoErrorKind {
+	if err == nil {
+		return uthoErrUnknown
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) {
+		return uthoErrTimeout
+	}
+
+	if errors.Is(err, errAPIUnavailable) {
+		return uthoErrUnavailable
+	}
+
+	var errResp *utho.ErrorResponse
+	if errors.As(err, &errResp) && errResp.Response != nil {
+		switch code := errResp.Response.StatusCode; {
+		case code == http.StatusNotFound:
+			return uthoErrNotFound
+		case code == http.StatusUnauthorized, code == http.StatusForbidden:
+			return uthoErrAuth
+		case code == http.StatusTooManyRequests:
+			return uthoErrRateLimited
+		case code == http.StatusPaymentRequired:
+			return uthoErrQuota
+		case code >= http.StatusInternalServerError:
+			return uthoErrUnavailable
+		case code == http.StatusBadRequest, code == http.StatusUnprocessableEntity:
+			// Utho also answers 400 for missing resources and exhausted quota,
+			// let the message decide before settling on a validation error
+			if kind := classifyUthoMessage(err.Error()); kind != uthoErrUnknown {
+				return kind
+			}
+			return uthoErrValidation
+		}
+
+		return classifyUthoMessage(err.Error())
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		if netErr.Timeout() {
+			return uthoErrTimeout
+		}
+		return uthoErrUnavailable
+	}
+
+	var uthoErr *UthoError
+	if errors.As(err, &uthoErr) {
+		return classifyUthoMessage(uthoErr.Message)
+	}
+
+	return uthoErrUnknown
+}
+
+func classifyUthoMessage(message string) uthoErrorKind {
+	message = strings.ToLower(message)
+
+	// order matters, "not currently attached" must win over the generic matches
+	// and a quota message often carries "invalid" or "must be" too
+	switch {
+	case containsAny(message, notAttachedMessages):
+		return uthoErrNotAttached
+	case containsAny(message, attachedMessages):
+		return uthoErrAttached
+	case containsAny(message, notFoundMessages):
+		return uthoErrNotFound
+	case containsAny(message, quotaMessages):
+		return uthoErrQuota
+	case containsAny(message, rateLimitMessages):
+		return uthoErrRateLimited
+	case containsAny(message, authMessages):
+		return uthoErrAuth
+	case containsAny(message, validationMessages):
+		return uthoErrValidation
+	}
+
+	return uthoErrUnknown
+}
+
+// code is the gRPC code the CSI sidecars expect for the kind of failure, it
+// decides whether they retry with backoff or give up on the request
+func (k uthoErrorKind) code() codes.Code {
+	switch k {
+	case uthoErrNotFound:
+		return codes.NotFound
+	case uthoErrNotAttached, uthoErrAttached:
+		return codes.FailedPrecondition
+	case uthoErrQuota:
+		return codes.ResourceExhausted
+	case uthoErrRateLimited, uthoErrUnavailable:
+		return codes.Unavailable
+	case uthoErrAuth:
+		return codes.Unauthenticated
+	case uthoErrValidation:
+		return codes.InvalidArgument
+	case uthoErrTimeout:
+		return codes.DeadlineExceeded
+	}
+
+	return codes.Internal
+}
+
+// uthoStatus turns an error from the Utho API into a gRPC status carrying the
+// code of its kind. Errors that already are a gRPC status are passed through
+func uthoStatus(err error, msg string) error {
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+
+	return status.Errorf(classifyUthoError(err).code(), "%s: %v", msg, err)
+}
+
+// isUthoRejected reports whether the API turned the request down, as opposed to failures
+// that leave it unknown whether the request went through
+func isUthoRejected(err error) bool {
+	switch classifyUthoError(err) {
+	case uthoErrNotFound, uthoErrNotAttached, uthoErrAttached, uthoErrQuota, uthoErrRateLimited, uthoErrAuth, uthoErrValidation:
+		return true
+	}
+	return false
+}
+
+func isUthoNotFound(err error) bool {
+	return classifyUthoError(err) == uthoErrNotFound
+}
+
+func isUthoNotAttached(err error) bool {
+	return classifyUthoError(err) == uthoErrNotAttached
+}
+
+func isUthoAttached(err error) bool {
+	return classifyUthoError(err) == uthoErrAttached
+}
+
+func containsAny(s string, substrs []string) bool {
+	for _, substr := range substrs {
+		if strings.Contains(s, substr) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,71 @@
+package driver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/uthoplatforms/utho-go/utho"
+	"google.golang.org/grpc/codes"
+)
+
+func apiErrorResponse(statusCode int, message string) error {
+	return &utho.ErrorResponse{
+		Response: &http.Response{
+			StatusCode: statusCode,
+			Request:    &http.Request{Method: http.MethodGet},
+		},
+		Errors: []utho.Error{{Message: message}},
+	}
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestClassifyUthoError(t *testing.T) {
+	var v struct{}
+	syntaxErr := json.Unmarshal([]byte("<html>Bad Gateway</html>"), &v)
+
+	tests := []struct {
+		name string
+		err  error
+		code codes.Code
+	}{
+		{name: "not found status", err: apiErrorResponse(http.StatusNotFound, "whatever"), code: codes.NotFound},
+		{name: "unauthorized status", err: apiErrorResponse(http.StatusUnauthorized, ""), code: codes.Unauthenticated},
+		{name: "rate limited status", err: apiErrorResponse(http.StatusTooManyRequests, ""), code: codes.Unavailable},
+		{name: "server error status", err: apiErrorResponse(http.StatusBadGateway, ""), code: codes.Unavailable},
+		{name: "bad request with a not found message", err: apiErrorResponse(http.StatusBadRequest, "Block storage not found"), code: codes.NotFound},
+		{name: "bad request", err: apiErrorResponse(http.StatusBadRequest, "something is off"), code: codes.InvalidArgument},
+		{name: "api message not attached", err: &UthoError{Message: "Block storage volume is not currently attached to a server"}, code: codes.FailedPrecondition},
+		{name: "api message attached", err: &UthoError{Message: "Block storage volume is attached to a server, detach it first"}, code: codes.FailedPrecondition},
+		{name: "api message not found", err: &UthoError{Message: "NotFound"}, code: codes.NotFound},
+		{name: "api message quota", err: &UthoError{Message: "block storage quota exceeded"}, code: codes.ResourceExhausted},
+		{name: "api message validation", err: &UthoError{Message: "disk is required"}, code: codes.InvalidArgument},
+		{name: "wrapped api message", err: fmt.Errorf("creating: %w", &UthoError{Message: "invalid dcslug"}), code: codes.InvalidArgument},
+		{name: "api message without a known fragment", err: &UthoError{Message: "something went wrong"}, code: codes.Internal},
+		{name: "json decode error of a proxy page", err: syntaxErr, code: codes.Internal},
+		{name: "plain error mentioning invalid", err: errors.New("invalid memory address"), code: codes.Internal},
+		{name: "plain error mentioning not found", err: errors.New("executable file not found"), code: codes.Internal},
+		{name: "network timeout", err: timeoutError{}, code: codes.DeadlineExceeded},
+		{name: "context deadline", err: context.DeadlineExceeded, code: codes.DeadlineExceeded},
+		{name: "circuit breaker open", err: errAPIUnavailable, code: codes.Unavailable},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.err == nil {
+				t.Fatal("test error is nil")
+			}
+			if got := classifyUthoError(tt.err).code(); got != tt.code {
+				t.Errorf("got code %v, want %v", got, tt.code)
+			}
+		})
+	}
+}
@@ -4,10 +4,8 @@ import (
 	"context"
 	"fmt"
 	"os"
-	"strings"
 	"time"
 
-	"github.com/uthoplatforms/utho-go/utho"
 	"golang.org/x/exp/rand"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
@@ -15,7 +13,7 @@ import (
 )
 
 // Get current Node Id from k8s node label
-func GetNodeId(client utho.Client) (string, error) {
+func GetNodeId(clusters Clusters) (string, error) {
 	// Retrieve the current node name from the environment variable
 	nodeName := os.Getenv("NODE_NAME")
 	if nodeName == "" {
@@ -39,49 +37,30 @@ func GetNodeId(client utho.Client) (string, error) {
 		return "", fmt.Errorf("error retrieving node: %w", err)
 	}
 
-	// Retrieve the nodepool_id label
-	cluster_id, found := node.Labels["cluster_id"]
-	fmt.Printf("cluster id '%s'\n", cluster_id)
+	return LookupNodeID(clusters, nodeName, node.Labels)
+}
+
+// LookupNodeID returns the cloud ID of the node from its cluster_id and nodepool_id labels
+func LookupNodeID(clusters Clusters, nodeName string, labels map[string]string) (string, error) {
+	clusterID, found := labels["cluster_id"]
 	if !found {
 		return "", fmt.Errorf("cluster_id label not found on node '%s'", nodeName)
 	}
+	fmt.Printf("cluster_id: '%s'\n", clusterID)
 
-	fmt.Printf("cluster_id: '%s'\n", cluster_id)
-	nodepool_id, found := node.Labels["nodepool_id"]
-	fmt.Printf("nodepool id '%s'\n", nodepool_id)
+	nodepoolID, found := labels["nodepool_id"]
 	if !found {
 		return "", fmt.Errorf("nodepool_id label not found on node '%s'", nodeName)
 	}
-	fmt.Printf("nodepool_id: '%s'\n", nodepool_id)
+	fmt.Printf("nodepool_id: '%s'\n", nodepoolID)
 
-	k8s, err := client.Kubernetes().Read(cluster_id)
+	nodeID, err := clusters.NodeID(clusterID, nodepoolID, nodeName)
 	if err != nil {
-		return "", fmt.Errorf("error retrieving Kubernetes with id '%s' %w", cluster_id, err)
+		return "", err
 	}
+	fmt.Printf("node id '%s'\n", nodeID)
 
-	var node_id string
-
-	if nodepool, exists := k8s.Nodepools[nodepool_id]; exists {
-		for _, node := range nodepool.Workers {
-			hostName := node.Hostname
-			fmt.Printf("Node hostName: '%s'\n", hostName)
-			fmt.Printf("nodeName: '%s'\n", nodeName)
-
-			if strings.EqualFold(hostName, nodeName) {
-				node_id = node.Cloudid
-				fmt.Printf("node_id inside if: '%s'\n", node_id)
-				fmt.Printf("node name if: '%s'=>'%s'\n", hostName, nodeName)
-				break
-			}
-			fmt.Printf("node_id outside if: '%s'\n", node_id)
-		}
-	} else {
-		fmt.Printf("node with name '%s' does not exist in the NodePool '%s'.\n", nodeName, nodepool_id)
-	}
-
-	fmt.Printf("node id '%s'\n", node_id)
-
-	return node_id, nil
+	return nodeID, nil
 }
 
 // GetClusterID gets the cluster ID from the first node in the cluster
@@ -115,15 +94,9 @@ func GetClusterID() (string, error) {
 	return "", fmt.Errorf("`cluster_id` label not found on the first node")
 }
 
-func GetDcslug(client utho.Client, clusterId string) (string, error) {
-	cluster, err := client.Kubernetes().Read(clusterId)
-	if err != nil {
-		return "", fmt.Errorf("unable to get kubernetes info: %v", err)
-	}
-
-	slug := cluster.Info.Cluster.Dcslug
-
-	return slug, nil
+// GetDcslug returns the datacenter of the cluster
+func GetDcslug(clusters Clusters, clusterId string) (string, error) {
+	return clusters.Dcslug(clusterId)
 }
 
 func GenerateRandomString(length int) string {
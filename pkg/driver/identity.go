@@ -4,6 +4,7 @@ import (
 	"context"
 
 	csi "github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/protobuf/types/known/wrapperspb"
 )
 
 var _ csi.IdentityServer = &UthoIdentityServer{}
@@ -40,6 +41,13 @@ func (uthoIdentity *UthoIdentityServer) GetPluginCapabilities(ctx context.Contex
 					},
 				},
 			},
+			{
+				Type: &csi.PluginCapability_Service_{
+					Service: &csi.PluginCapability_Service{
+						Type: csi.PluginCapability_Service_VOLUME_ACCESSIBILITY_CONSTRAINTS,
+					},
+				},
+			},
 		},
 	}, nil
 }
@@ -48,5 +56,8 @@ func (uthoIdentity *UthoIdentityServer) GetPluginCapabilities(ctx context.Contex
 func (uthoIdentity *UthoIdentityServer) Probe(ctx context.Context, req *csi.ProbeRequest) (*csi.ProbeResponse, error) {
 	uthoIdentity.Driver.log.Infof("UthoIdentityServer.Probe called with request : %v", req)
 
-	return &csi.ProbeResponse{}, nil
+	// the plugin is ready whether or not the Utho API is up: livenessprobe restarts the
+	// plugin when Probe fails, which won't bring the API back. The circuit breaker fails
+	// the calls that need the API instead
+	return &csi.ProbeResponse{Ready: wrapperspb.Bool(true)}, nil
 }
@@ -0,0 +1,60 @@
+package driver
+
+import (
+	"sync"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// volumeLocks tracks the volume and snapshot names and IDs that have an operation
+// in flight, so concurrent calls for the same one are rejected instead of racing
+type volumeLocks struct {
+	mu       sync.Mutex
+	inFlight map[string]struct{}
+}
+
+func newVolumeLocks() *volumeLocks {
+	return &volumeLocks{
+		inFlight: map[string]struct{}{},
+	}
+}
+
+// tryAcquire takes the lock for key, it returns false if it is already held
+func (l *volumeLocks) tryAcquire(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if _, ok := l.inFlight[key]; ok {
+		return false
+	}
+	l.inFlight[key] = struct{}{}
+	return true
+}
+
+func (l *volumeLocks) release(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.inFlight, key)
+}
+
+// Prefixes of the lock keys, so a volume name can't collide with a volume ID
+// or a snapshot that happens to use the same string
+const (
+	lockVolumeID     = "volume-id/"
+	lockVolumeName   = "volume-name/"
+	lockSnapshotID   = "snapshot-id/"
+	lockSnapshotName = "snapshot-name/"
+)
+
+// lock takes the operation lock for a volume or snapshot, keyed by one of the lock prefixes
+// and the name or ID. It returns Aborted if another operation holds it, as the CSI spec
+// recommends, so the CO retries later
+func (d *UthoDriver) lock(prefix, key string) (func(), error) {
+	if !d.volumeLocks.tryAcquire(prefix + key) {
+		return nil, status.Errorf(codes.Aborted, "an operation for %s%s is already in progress", prefix, key)
+	}
+
+	return func() { d.volumeLocks.release(prefix + key) }, nil
+}
@@ -0,0 +1,95 @@
+package driver
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Parameters the external-provisioner adds to CreateVolume with --extra-create-metadata
+const (
+	paramPVCName      = "csi.storage.k8s.io/pvc/name"
+	paramPVCNamespace = "csi.storage.k8s.io/pvc/namespace"
+	paramPVName       = "csi.storage.k8s.io/pv/name"
+)
+
+// legacyVolumeName matches the names of the volumes created before names were prefixed
+// with the cluster, they were named after their PV: pvc-<uid of the PVC>, or the first 16
+// hex digits of the uid with the --volume-name-uuid-length=16 of the deployed provisioner
+var legacyVolumeName = regexp.MustCompile(`^pvc-([0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}|[0-9a-f]{16})$`)
+
+// volumeMetadata is the PVC a volume is created for, when the provisioner passes it
+type volumeMetadata struct {
+	pvcNamespace string
+	pvcName      string
+}
+
+// extractMetadata splits the provisioner metadata off the StorageClass parameters
+// and returns the remaining parameters along with the PVC the volume is for
+func extractMetadata(params map[string]string) (map[string]string, volumeMetadata) {
+	remaining := make(map[string]string, len(params))
+	for key, value := range params {
+		switch key {
+		case paramPVCName, paramPVCNamespace, paramPVName:
+		default:
+			remaining[key] = value
+		}
+	}
+
+	return remaining, volumeMetadata{
+		pvcNamespace: params[paramPVCNamespace],
+		pvcName:      params[paramPVCName],
+	}
+}
+
+// volumeNamePrefix is put in front of the name of every volume the driver creates in a
+// cluster. Utho volumes have a name but no tags or description, so ownership is read
+// from the name
+func (d *UthoDriver) volumeNamePrefix() string {
+	return "csi-" + d.clusterID + "-"
+}
+
+// ebsName returns the Utho name of the volume the CO names volName, which also carries the
+// PVC it is for when the provisioner passes it: csi-<cluster id>-<volName>-<namespace>-<pvc>
+func (d *UthoDriver) ebsName(volName string, metadata volumeMetadata) string {
+	if d.clusterID == "" {
+		return volName
+	}
+
+	name := d.volumeNamePrefix() + volName
+	if metadata.pvcNamespace != "" && metadata.pvcName != "" {
+		name += "-" + metadata.pvcNamespace + "-" + metadata.pvcName
+	}
+	return name
+}
+
+// ownsVolume reports whether the volume was created by this driver in this cluster.
+// Without a cluster ID (debug mode) there is nothing to scope by and every volume is owned.
+// Volumes created before names were prefixed can't be told apart by cluster, they keep
+// being managed like they were so existing PVs still work
+func (d *UthoDriver) ownsVolume(volume Volume) bool {
+	if d.clusterID == "" {
+		return true
+	}
+
+	return strings.HasPrefix(volume.Name, d.volumeNamePrefix()) || legacyVolumeName.MatchString(volume.Name)
+}
+
+// canManageVolume reports whether the driver may change the volume, either because it owns
+// it or because adopting volumes from elsewhere was explicitly allowed
+func (d *UthoDriver) canManageVolume(volume Volume) bool {
+	if d.ownsVolume(volume) {
+		return true
+	}
+
+	if d.adoptForeignVolumes {
+		d.log.WithFields(logrus.Fields{
+			"volume-id":   volume.ID,
+			"volume-name": volume.Name,
+		}).Warn("adopting volume that is not owned by this cluster")
+		return true
+	}
+
+	return false
+}
@@ -2,11 +2,10 @@ package driver
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"strings"
 
@@ -20,8 +19,9 @@ import (
 )
 
 const (
-	diskPath   = "/dev/disk/by-id"
-	diskPrefix = "virtio-uthostorage-"
+	diskPath = "/dev/disk/by-id"
+
+	mountInfoPath = "/proc/self/mountinfo"
 
 	mkDirMode = 0750
 
@@ -29,6 +29,9 @@ const (
 
 	volumeModeBlock      = "block"
 	volumeModeFilesystem = "filesystem"
+
+	// topologyRegionKey is the topology segment holding the Utho dcslug of a node
+	topologyRegionKey = "region"
 )
 
 var _ csi.NodeServer = &UthoNodeServer{}
@@ -37,11 +40,19 @@ var _ csi.NodeServer = &UthoNodeServer{}
 type UthoNodeServer struct {
 	csi.UnimplementedNodeServer
 	Driver *UthoDriver
+
+	devices *deviceResolver
+	// stat is unix.Stat, tests stand in for the device numbers of block devices
+	stat func(path string, st *unix.Stat_t) error
 }
 
 // NewUthoNodeDriver provides a UthoNodeServer
 func NewUthoNodeDriver(driver *UthoDriver) *UthoNodeServer {
-	return &UthoNodeServer{Driver: driver}
+	return &UthoNodeServer{
+		Driver:  driver,
+		devices: newDeviceResolver(),
+		stat:    unix.Stat,
+	}
 }
 
 // NodeStageVolume provides stages the node volume
@@ -65,19 +76,52 @@ func (n *UthoNodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStage
 		"capacity": req.VolumeCapability,
 	}).Info("Node Stage Volume: called")
 
+	unlock, err := n.Driver.lock(lockVolumeID, req.VolumeId)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	// raw block volumes are bind mounted straight from the device in NodePublishVolume
+	if req.VolumeCapability.GetBlock() != nil {
+		n.Driver.log.WithFields(logrus.Fields{
+			"volume": req.VolumeId,
+			"target": req.StagingTargetPath,
+		}).Info("Node Stage Volume: raw block volume, nothing to stage")
+		return &csi.NodeStageVolumeResponse{}, nil
+	}
+
+	mountBlk := req.VolumeCapability.GetMount()
+	if mountBlk == nil {
+		return nil, status.Error(codes.InvalidArgument, "NodeStageVolume Volume Capability must be a block or mount volume")
+	}
+
 	volumeID, ok := req.GetPublishContext()[n.Driver.publishVolumeID]
 	if !ok {
 		return nil, status.Error(codes.InvalidArgument, "Could not find the volume id")
 	}
 
-	source := getDeviceByPath(volumeID)
+	source, err := n.devices.resolve(ctx, volumeID)
+	if err != nil {
+		return nil, err
+	}
+
 	target := req.StagingTargetPath
-	mountBlk := req.VolumeCapability.GetMount()
 	options := mountBlk.MountFlags
 
-	fsType := "ext4"
-	if mountBlk.FsType != "" {
-		fsType = mountBlk.FsType
+	fsType := stageFsType(req)
+
+	// checked before creating the directory, which fails on a corrupted mount point
+	mounted, err := n.checkMounted(source, target, false, options)
+	if err != nil {
+		return nil, err
+	}
+	if mounted {
+		n.Driver.log.WithFields(logrus.Fields{
+			"volume": req.VolumeId,
+			"target": req.StagingTargetPath,
+		}).Info("Node Stage Volume: volume already staged")
+		return &csi.NodeStageVolumeResponse{}, nil
 	}
 
 	n.Driver.log.WithFields(logrus.Fields{
@@ -86,7 +130,7 @@ func (n *UthoNodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStage
 		"capacity": req.VolumeCapability,
 	}).Infof("Node Stage Volume: creating directory target %s\n", target)
 
-	err := os.MkdirAll(target, mkDirMode)
+	err = os.MkdirAll(target, mkDirMode)
 	if err != nil {
 		return nil, status.Error(codes.Internal, err.Error())
 	}
@@ -97,6 +141,10 @@ func (n *UthoNodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStage
 		"capacity": req.VolumeCapability,
 	}).Infof("Node Stage Volume: directory created for target %s\n", target)
 
+	if err := n.checkDeviceBeforeFormat(volumeID, source, target, fsType); err != nil {
+		return nil, err
+	}
+
 	n.Driver.log.WithFields(logrus.Fields{
 		"volume":   req.VolumeId,
 		"target":   req.StagingTargetPath,
@@ -145,6 +193,12 @@ func (n *UthoNodeServer) NodeUnstageVolume(ctx context.Context, req *csi.NodeUns
 		"staging-target-path": req.StagingTargetPath,
 	}).Info("Node Unstage Volume: called")
 
+	unlock, err := n.Driver.lock(lockVolumeID, req.VolumeId)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
 	n.Driver.log.WithFields(logrus.Fields{
 		"volume-id":   req.VolumeId,
 		"target-path": req.StagingTargetPath,
@@ -152,7 +206,7 @@ func (n *UthoNodeServer) NodeUnstageVolume(ctx context.Context, req *csi.NodeUns
 
 	mounted, err := n.isMounted(req.StagingTargetPath)
 	if err != nil {
-		return nil, err
+		return nil, status.Errorf(codes.Internal, "failed to check if %q is mounted: %v", req.StagingTargetPath, err)
 	}
 
 	if mounted {
@@ -185,6 +239,10 @@ func (n *UthoNodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePub
 		return nil, status.Error(codes.InvalidArgument, "Target Path must be provided")
 	}
 
+	if req.VolumeCapability == nil {
+		return nil, status.Error(codes.InvalidArgument, "Volume Capability must be provided")
+	}
+
 	log := n.Driver.log.WithFields(logrus.Fields{
 		"volume_id":           req.VolumeId,
 		"staging_target_path": req.StagingTargetPath,
@@ -192,12 +250,25 @@ func (n *UthoNodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePub
 	})
 	log.Info("Node Publish Volume: called")
 
+	unlock, err := n.Driver.lock(lockVolumeID, req.VolumeId)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
 	options := []string{"bind"}
 	if req.Readonly {
 		options = append(options, "ro")
 	}
 
+	if req.VolumeCapability.GetBlock() != nil {
+		return n.publishBlockVolume(ctx, req, options)
+	}
+
 	mnt := req.VolumeCapability.GetMount()
+	if mnt == nil {
+		return nil, status.Error(codes.InvalidArgument, "Volume Capability must be a block or mount volume")
+	}
 	options = append(options, mnt.MountFlags...)
 
 	fsType := "ext4"
@@ -205,7 +276,16 @@ func (n *UthoNodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePub
 		fsType = mnt.FsType
 	}
 
-	err := os.MkdirAll(req.TargetPath, mkDirMode)
+	mounted, err := n.checkMounted(req.StagingTargetPath, req.TargetPath, req.Readonly, options)
+	if err != nil {
+		return nil, err
+	}
+	if mounted {
+		log.Info("Node Publish Volume: volume already published")
+		return &csi.NodePublishVolumeResponse{}, nil
+	}
+
+	err = os.MkdirAll(req.TargetPath, mkDirMode)
 	if err != nil {
 		return nil, status.Error(codes.Internal, err.Error())
 	}
@@ -235,10 +315,16 @@ func (n *UthoNodeServer) NodeUnpublishVolume(ctx context.Context, req *csi.NodeU
 		"target-path": req.TargetPath,
 	}).Info("Node Unpublish Volume: called")
 
-	mounted, err := n.isMounted(req.TargetPath)
+	unlock, err := n.Driver.lock(lockVolumeID, req.VolumeId)
 	if err != nil {
 		return nil, err
 	}
+	defer unlock()
+
+	mounted, err := n.isMounted(req.TargetPath)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to check if %q is mounted: %v", req.TargetPath, err)
+	}
 
 	if mounted {
 		n.Driver.log.Info("unmounting the staging target path")
@@ -251,6 +337,13 @@ func (n *UthoNodeServer) NodeUnpublishVolume(ctx context.Context, req *csi.NodeU
 		n.Driver.log.Info("staging target path is already unmounted")
 	}
 
+	// the target of a raw block volume is a file we created in NodePublishVolume
+	if info, err := os.Stat(req.TargetPath); err == nil && !info.IsDir() {
+		if err := os.Remove(req.TargetPath); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to remove block volume target %q: %v", req.TargetPath, err)
+		}
+	}
+
 	n.Driver.log.Info("Node Publish Volume: unpublished")
 	return &csi.NodeUnpublishVolumeResponse{}, nil
 }
@@ -283,6 +376,32 @@ func (n *UthoNodeServer) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGe
 		return nil, status.Errorf(codes.NotFound, "volume path %q is not mounted", volumePath)
 	}
 
+	isBlock, err := isBlockVolume(volumePath)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to check if volume path %q is a block device: %s", volumePath, err)
+	}
+
+	if isBlock {
+		size, err := blockDeviceSize(volumePath)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to get size of block device %q: %s", volumePath, err)
+		}
+
+		log.WithFields(logrus.Fields{
+			"volume_mode": volumeModeBlock,
+			"bytes_total": size,
+		}).Info("node capacity statistics retrieved")
+
+		return &csi.NodeGetVolumeStatsResponse{
+			Usage: []*csi.VolumeUsage{
+				{
+					Total: size,
+					Unit:  csi.VolumeUsage_BYTES,
+				},
+			},
+		}, nil
+	}
+
 	statfs := &unix.Statfs_t{}
 	err = unix.Statfs(volumePath, statfs)
 	if err != nil {
@@ -326,6 +445,14 @@ func (n *UthoNodeServer) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGe
 
 // NodeExpandVolume provides the node volume expansion
 func (n *UthoNodeServer) NodeExpandVolume(ctx context.Context, req *csi.NodeExpandVolumeRequest) (*csi.NodeExpandVolumeResponse, error) {
+	if req.VolumeId == "" {
+		return nil, status.Error(codes.InvalidArgument, "NodeExpandVolume Volume ID must be provided")
+	}
+
+	if req.VolumePath == "" {
+		return nil, status.Error(codes.InvalidArgument, "NodeExpandVolume Volume Path must be provided")
+	}
+
 	log := n.Driver.log.WithFields(logrus.Fields{
 		"volume_id":   req.VolumeId,
 		"volume_path": req.VolumePath,
@@ -333,10 +460,24 @@ func (n *UthoNodeServer) NodeExpandVolume(ctx context.Context, req *csi.NodeExpa
 	})
 
 	n.Driver.log.WithFields(logrus.Fields{
-		"required_bytes": req.CapacityRange.RequiredBytes,
+		"required_bytes": req.CapacityRange.GetRequiredBytes(),
 	}).Info("Node Expand Volume: called")
 
-	devicePath, _, err := mount.GetDeviceNameFromMount(mount.New(""), req.VolumePath)
+	unlock, err := n.Driver.lock(lockVolumeID, req.VolumeId)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	// a raw block volume has no filesystem to grow
+	if req.VolumeCapability.GetBlock() != nil {
+		log.Info("raw block volume, nothing to resize")
+		return &csi.NodeExpandVolumeResponse{
+			CapacityBytes: req.CapacityRange.GetRequiredBytes(),
+		}, nil
+	}
+
+	devicePath, _, err := mount.GetDeviceNameFromMount(n.Driver.mounter, req.VolumePath)
 	if err != nil {
 		log.Infof("failed to determine mount path for %s: %s", req.VolumePath, err)
 		return nil, fmt.Errorf("failed to determine mount path for %s: %s", req.VolumePath, err)
@@ -350,7 +491,7 @@ func (n *UthoNodeServer) NodeExpandVolume(ctx context.Context, req *csi.NodeExpa
 	}
 
 	return &csi.NodeExpandVolumeResponse{
-		CapacityBytes: req.CapacityRange.RequiredBytes,
+		CapacityBytes: req.CapacityRange.GetRequiredBytes(),
 	}, nil
 }
 
@@ -371,6 +512,13 @@ func (n *UthoNodeServer) NodeGetCapabilities(context.Context, *csi.NodeGetCapabi
 				},
 			},
 		},
+		{
+			Type: &csi.NodeServiceCapability_Rpc{
+				Rpc: &csi.NodeServiceCapability_RPC{
+					Type: csi.NodeServiceCapability_RPC_EXPAND_VOLUME,
+				},
+			},
+		},
 	}
 
 	n.Driver.log.WithFields(logrus.Fields{
@@ -391,7 +539,7 @@ func (n *UthoNodeServer) NodeGetInfo(ctx context.Context, req *csi.NodeGetInfoRe
 		MaxVolumesPerNode: maxVolumesPerNode,
 		AccessibleTopology: &csi.Topology{
 			Segments: map[string]string{
-				"region": n.Driver.dcslug,
+				topologyRegionKey: n.Driver.dcslug,
 			},
 		},
 	}
@@ -405,75 +553,332 @@ func (n *UthoNodeServer) NodeGetInfo(ctx context.Context, req *csi.NodeGetInfoRe
 	return &res, nil
 }
 
-func getDeviceByPath(volumeID string) string {
-	return filepath.Join(diskPath, fmt.Sprintf("%s%s", diskPrefix, volumeID))
-}
+// publishBlockVolume bind mounts the device of a raw block volume onto a file at the target path
+func (n *UthoNodeServer) publishBlockVolume(ctx context.Context, req *csi.NodePublishVolumeRequest, options []string) (*csi.NodePublishVolumeResponse, error) { //nolint:lll
+	volumeID, ok := req.GetPublishContext()[n.Driver.publishVolumeID]
+	if !ok {
+		return nil, status.Error(codes.InvalidArgument, "Could not find the volume id")
+	}
 
-type findmntResponse struct {
-	FileSystems []fileSystem `json:"filesystems"`
+	source, err := n.devices.resolve(ctx, volumeID)
+	if err != nil {
+		return nil, err
+	}
+
+	// checked before creating the target, which fails on a corrupted mount point
+	mounted, err := n.checkMounted(source, req.TargetPath, req.Readonly, options)
+	if err != nil {
+		return nil, err
+	}
+	if mounted {
+		n.Driver.log.WithFields(logrus.Fields{
+			"volume_id":   req.VolumeId,
+			"target_path": req.TargetPath,
+		}).Info("Node Publish Volume: volume already published")
+		return &csi.NodePublishVolumeResponse{}, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(req.TargetPath), mkDirMode); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	file, err := os.OpenFile(req.TargetPath, os.O_CREATE, 0660)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to create block volume target %q: %v", req.TargetPath, err)
+	}
+	file.Close()
+
+	n.Driver.log.WithFields(logrus.Fields{
+		"volume_id":   req.VolumeId,
+		"source":      source,
+		"target_path": req.TargetPath,
+	}).Info("Node Publish Volume: bind mounting block device")
+
+	if err := n.Driver.mounter.Mount(source, req.TargetPath, "", options); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	n.Driver.log.Info("Node Publish Volume: published")
+	return &csi.NodePublishVolumeResponse{}, nil
 }
-type fileSystem struct {
-	Target      string `json:"target"`
-	Propagation string `json:"propagation"`
-	FsType      string `json:"fstype"`
-	Options     string `json:"options"`
+
+// perMountFlags are the mount flags the kernel reports back for a mount, the ones a
+// repeated request can be compared on
+var perMountFlags = map[string]bool{
+	"nodev":       true,
+	"noexec":      true,
+	"nosuid":      true,
+	"noatime":     true,
+	"nodiratime":  true,
+	"relatime":    true,
+	"strictatime": true,
 }
 
-func (n *UthoNodeServer) isMounted(target string) (bool, error) {
-	if target == "" {
-		return false, errors.New("target is not specified for checking the mount")
+// checkMounted reports whether target is already mounted from source, so repeated stage and
+// publish calls don't stack mounts. A mount of something else or with other options is
+// AlreadyExists, a corrupted mount point, e.g. left by a dead mount, is cleaned up so it
+// can be mounted again
+func (n *UthoNodeServer) checkMounted(source, target string, readonly bool, options []string) (bool, error) {
+	_, err := os.Stat(target)
+	switch {
+	case err != nil && errors.Is(err, os.ErrNotExist):
+		return false, nil
+	case err != nil && mount.IsCorruptedMnt(err):
+		n.Driver.log.WithFields(logrus.Fields{
+			"target": target,
+			"error":  err,
+		}).Warn("cleaning up corrupted mount point")
+
+		if err := mount.CleanupMountPoint(target, n.Driver.mounter, true); err != nil {
+			return false, status.Errorf(codes.Internal, "failed to clean up corrupted mount point %q: %v", target, err)
+		}
+		return false, nil
+	case err != nil:
+		return false, status.Errorf(codes.Internal, "failed to check if %q is mounted: %v", target, err)
 	}
 
-	findmntCmd := "findmnt"
-	_, err := exec.LookPath(findmntCmd)
+	mounted, err := n.isMounted(target)
 	if err != nil {
-		if err == exec.ErrNotFound {
-			return false, fmt.Errorf("%q executable not found in $PATH", findmntCmd)
+		return false, status.Errorf(codes.Internal, "failed to check if %q is mounted: %v", target, err)
+	}
+	if !mounted {
+		return false, nil
+	}
+
+	same, err := n.sameSource(source, target)
+	if err != nil {
+		return false, status.Errorf(codes.Internal, "failed to compare the mount of %q with %q: %v", target, source, err)
+	}
+	if !same {
+		return false, status.Errorf(codes.AlreadyExists, "%q is already mounted from another source than %q", target, source)
+	}
+
+	mountPoints, err := n.Driver.mounter.List()
+	if err != nil {
+		return false, status.Errorf(codes.Internal, "failed to list mounts: %v", err)
+	}
+
+	// the last mount of the path is the one on top
+	var opts []string
+	for _, mp := range mountPoints {
+		if mp.Path == target {
+			opts = mp.Opts
+		}
+	}
+
+	mountedOpts := map[string]bool{}
+	for _, opt := range opts {
+		mountedOpts[opt] = true
+	}
+
+	if mountedOpts["ro"] != readonly {
+		return false, status.Errorf(codes.AlreadyExists, "%q is already mounted with read-only %t", target, mountedOpts["ro"])
+	}
+
+	for _, opt := range options {
+		if perMountFlags[opt] && !mountedOpts[opt] {
+			return false, status.Errorf(codes.AlreadyExists, "%q is already mounted without %q", target, opt)
 		}
+	}
+
+	return true, nil
+}
+
+// sameSource reports whether the mount at target is the one of source, a device staged at
+// target, the bind mount of a device file or the bind mount of a staging directory
+func (n *UthoNodeServer) sameSource(source, target string) (bool, error) {
+	var src, dst unix.Stat_t
+	if err := n.stat(source, &src); err != nil {
+		return false, err
+	}
+	if err := n.stat(target, &dst); err != nil {
 		return false, err
 	}
 
-	findmntArgs := []string{"-o", "TARGET,PROPAGATION,FSTYPE,OPTIONS", "-M", target, "-J"}
+	if src.Mode&unix.S_IFMT != unix.S_IFBLK {
+		return src.Dev == dst.Dev, nil
+	}
 
-	n.Driver.log.WithFields(logrus.Fields{
-		"cmd":  findmntCmd,
-		"args": findmntArgs,
-	}).Info("checking if target is mounted")
+	if dst.Mode&unix.S_IFMT == unix.S_IFBLK {
+		return src.Rdev == dst.Rdev, nil
+	}
+	return src.Rdev == dst.Dev, nil
+}
 
-	out, err := exec.Command(findmntCmd, findmntArgs...).CombinedOutput()
+// stageFsType returns the filesystem to format the volume with. The fsType of the StorageClass
+// wins over the volume capability, the external-provisioner fills the capability with its
+// --default-fstype whenever the StorageClass doesn't set csi.storage.k8s.io/fstype
+func stageFsType(req *csi.NodeStageVolumeRequest) string {
+	if fsType := req.GetVolumeContext()[paramFsType]; fsType != "" {
+		return fsType
+	}
+	if fsType := req.GetVolumeCapability().GetMount().GetFsType(); fsType != "" {
+		return fsType
+	}
+	return defaultFsType
+}
+
+// checkDeviceBeforeFormat refuses to hand a device to FormatAndMount unless it is the disk of
+// the volume, it isn't in use anywhere but the staging path, and it is either blank or
+// carries a filesystem of the requested type. mkfs on the wrong disk loses someone's data
+func (n *UthoNodeServer) checkDeviceBeforeFormat(volumeID, source, target, fsType string) error {
+	if err := n.devices.verifySerial(source, volumeID); err != nil {
+		return err
+	}
+
+	resolved, err := filepath.EvalSymlinks(source)
 	if err != nil {
-		// findmnt exits with non zero exit status if it couldn't find anything
-		if strings.TrimSpace(string(out)) == "" {
-			return false, nil
+		return status.Errorf(codes.Internal, "cannot resolve device %s: %v", source, err)
+	}
+
+	mountPoints, err := n.Driver.mounter.List()
+	if err != nil {
+		return status.Errorf(codes.Internal, "cannot list mounts: %v", err)
+	}
+
+	for _, mp := range mountPoints {
+		if mp.Path == target {
+			continue
 		}
 
-		return false, fmt.Errorf("checking mounted failed: %v cmd: %q output: %q",
-			err, findmntCmd, string(out))
+		device := mp.Device
+		if evaluated, err := filepath.EvalSymlinks(device); err == nil {
+			device = evaluated
+		}
+		if device == resolved {
+			return status.Errorf(codes.FailedPrecondition, "device %s of volume %s is already mounted at %s", resolved, volumeID, mp.Path)
+		}
 	}
 
-	// no response means there is no mount
-	if string(out) == "" {
-		return false, nil
+	holders, err := n.devices.holders(source)
+	if err != nil {
+		return status.Errorf(codes.Internal, "cannot list the holders of device %s: %v", resolved, err)
+	}
+	if len(holders) > 0 {
+		return status.Errorf(codes.FailedPrecondition, "device %s of volume %s is held by %s", resolved, volumeID, strings.Join(holders, ", "))
 	}
 
-	var resp *findmntResponse
-	err = json.Unmarshal(out, &resp)
+	format, err := n.Driver.mounter.GetDiskFormat(source)
 	if err != nil {
-		return false, fmt.Errorf("couldn't unmarshal data: %q: %s", string(out), err)
+		return status.Errorf(codes.Internal, "cannot determine the format of device %s: %v", resolved, err)
 	}
 
-	targetFound := false
-	for _, fs := range resp.FileSystems {
-		// check if the mount is propagated correctly. It should be set to shared.
-		if fs.Propagation != "shared" {
-			return true, fmt.Errorf("mount propagation for target %q is not enabled", target)
-		}
+	switch {
+	case format == "":
+		// blank disk, FormatAndMount will create the filesystem
+	case strings.Contains(format, "partition"):
+		return status.Errorf(codes.FailedPrecondition, "device %s of volume %s has a partition table, refusing to format it", resolved, volumeID)
+	case format != fsType:
+		return status.Errorf(codes.FailedPrecondition, "device %s of volume %s already has a %s filesystem, %s was requested", resolved, volumeID, format, fsType)
+	}
+
+	return nil
+}
 
-		// the mountpoint should match as well
-		if fs.Target == target {
+// isBlockVolume reports whether path is the target of a raw block volume, the file the device
+// is bind mounted onto in publishBlockVolume, rather than the directory of a filesystem volume
+func isBlockVolume(path string) (bool, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return false, err
+	}
+
+	return !info.IsDir(), nil
+}
+
+// blockDeviceSize returns the size in bytes of the block device at path
+func blockDeviceSize(path string) (int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	return file.Seek(0, io.SeekEnd)
+}
+
+// isMounted reports whether target is a mount point, using the mounts the kernel reports
+// through the mounter so it can be faked. A mount that isn't shared is still a mount, the
+// propagation is only checked to warn about it
+func (n *UthoNodeServer) isMounted(target string) (bool, error) {
+	if target == "" {
+		return false, errors.New("target is not specified for checking the mount")
+	}
+
+	mountPoints, err := n.Driver.mounter.List()
+	if err != nil {
+		return false, fmt.Errorf("failed to list mounts: %v", err)
+	}
+
+	targetFound := false
+	for _, mp := range mountPoints {
+		if mp.Path == target {
 			targetFound = true
+			break
 		}
 	}
 
+	if targetFound {
+		n.checkPropagation(target)
+	}
+
 	return targetFound, nil
 }
+
+// mountInfoLister is implemented by the mounters that can tell the propagation of mounts
+type mountInfoLister interface {
+	MountInfo() ([]mount.MountInfo, error)
+}
+
+// procMounter is the mounter of the host, which reads the propagation of its
+// mounts from /proc/self/mountinfo
+type procMounter struct {
+	mount.Interface
+}
+
+var _ mountInfoLister = &procMounter{}
+
+func newProcMounter() *procMounter {
+	return &procMounter{Interface: mount.New("")}
+}
+
+func (m *procMounter) MountInfo() ([]mount.MountInfo, error) {
+	return mount.ParseMountInfo(mountInfoPath)
+}
+
+// checkPropagation warns when the mount at target isn't shared, mounts made under it
+// then don't show up in the containers using it. Mounters that can't tell are trusted
+func (n *UthoNodeServer) checkPropagation(target string) {
+	lister, ok := n.Driver.mounter.Interface.(mountInfoLister)
+	if !ok {
+		return
+	}
+
+	infos, err := lister.MountInfo()
+	if err != nil {
+		n.Driver.log.WithFields(logrus.Fields{
+			"target": target,
+			"error":  err,
+		}).Warn("cannot read the mount propagation")
+		return
+	}
+
+	for _, info := range infos {
+		if info.MountPoint != target {
+			continue
+		}
+
+		shared := false
+		for _, field := range info.OptionalFields {
+			if strings.HasPrefix(field, "shared:") {
+				shared = true
+			}
+		}
+
+		if !shared {
+			n.Driver.log.WithFields(logrus.Fields{
+				"target": target,
+			}).Warn("mount propagation is not shared")
+		}
+	}
+}
@@ -0,0 +1,709 @@
+package driver
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	"golang.org/x/sys/unix"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/mount-utils"
+	"k8s.io/utils/exec"
+	testingexec "k8s.io/utils/exec/testing"
+)
+
+const testVolumeID = "vol-1"
+
+// testNode is a node server running against a fake mounter, with the disks it
+// finds laid out under a temporary directory
+type testNode struct {
+	*UthoNodeServer
+	mounter *mount.FakeMounter
+	exec    commandExec
+	logs    *logtest.Hook
+	dir     string
+}
+
+// mountInfoMounter is a fake mounter that also tells the propagation of mounts
+type mountInfoMounter struct {
+	*mount.FakeMounter
+	infos []mount.MountInfo
+}
+
+func (m *mountInfoMounter) MountInfo() ([]mount.MountInfo, error) {
+	return m.infos, nil
+}
+
+// commandExec runs no command, it answers each one with what its handler returns for the
+// arguments, commands without a handler succeed without output
+type commandExec map[string]func(args ...string) (string, error)
+
+var _ exec.Interface = commandExec{}
+
+func (e commandExec) Command(cmd string, args ...string) exec.Cmd {
+	var output string
+	var err error
+	if handler, ok := e[cmd]; ok {
+		output, err = handler(args...)
+	}
+
+	action := func() ([]byte, []byte, error) { return []byte(output), nil, err }
+	return testingexec.InitFakeCmd(&testingexec.FakeCmd{
+		CombinedOutputScript: []testingexec.FakeAction{action},
+		OutputScript:         []testingexec.FakeAction{action},
+		RunScript:            []testingexec.FakeAction{action},
+	}, cmd, args...)
+}
+
+func (e commandExec) CommandContext(_ context.Context, cmd string, args ...string) exec.Cmd {
+	return e.Command(cmd, args...)
+}
+
+func (e commandExec) LookPath(file string) (string, error) {
+	return file, nil
+}
+
+// blkid answers like blkid for a disk with the given blkid export output, a blank disk
+// has none and makes blkid exit with 2
+func blkid(output string) func(args ...string) (string, error) {
+	return func(args ...string) (string, error) {
+		if output == "" {
+			return "", testingexec.FakeExitError{Status: 2}
+		}
+		return output, nil
+	}
+}
+
+func newTestNode(t *testing.T) *testNode {
+	t.Helper()
+
+	dir := t.TempDir()
+	for _, sub := range []string{"by-id", "sys", "dev", "mnt"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), mkDirMode); err != nil {
+			t.Fatalf("cannot create %s: %v", sub, err)
+		}
+	}
+
+	mounter := mount.NewFakeMounter(nil)
+	commands := commandExec{}
+	logger, logs := logtest.NewNullLogger()
+	d := &UthoDriver{
+		name:        DefaultDriverName,
+		log:         logrus.NewEntry(logger),
+		volumeLocks: newVolumeLocks(),
+		mounter:     &mount.SafeFormatAndMount{Interface: mounter, Exec: commands},
+	}
+
+	d.resizer = mount.NewResizeFs(commands)
+
+	node := NewUthoNodeDriver(d)
+	node.devices = &deviceResolver{
+		byIDPath: filepath.Join(dir, "by-id"),
+		sysPath:  filepath.Join(dir, "sys"),
+		devPath:  filepath.Join(dir, "dev"),
+		timeout:  100 * time.Millisecond,
+		interval: 10 * time.Millisecond,
+	}
+
+	return &testNode{UthoNodeServer: node, mounter: mounter, exec: commands, logs: logs, dir: dir}
+}
+
+// addDisk lays out the disk of the volume as udev and sysfs show it, see addDevice, along
+// with its by-id link. It returns the by-id link
+func (n *testNode) addDisk(t *testing.T, name, volumeID string, sizeBytes int64) string {
+	t.Helper()
+
+	device := n.addDevice(t, name, serialPrefix+volumeID, sizeBytes)
+
+	link := filepath.Join(n.dir, "by-id", byIDNames(serialPrefix + volumeID)[0])
+	if err := os.Symlink(device, link); err != nil {
+		t.Fatalf("cannot link device: %v", err)
+	}
+	return link
+}
+
+// addDevice creates a device file of sizeBytes along with its serial and size in sysfs,
+// and returns the device file
+func (n *testNode) addDevice(t *testing.T, name, serial string, sizeBytes int64) string {
+	t.Helper()
+
+	device := filepath.Join(n.dir, "dev", name)
+	file, err := os.Create(device)
+	if err != nil {
+		t.Fatalf("cannot create device: %v", err)
+	}
+	defer file.Close()
+	if err := file.Truncate(sizeBytes); err != nil {
+		t.Fatalf("cannot size device: %v", err)
+	}
+
+	n.writeSys(t, name, "serial", serial)
+	n.writeSys(t, name, "size", strconv.FormatInt(sizeBytes/sectorSize, 10))
+
+	return device
+}
+
+// writeSys writes the sysfs attribute of the block device
+func (n *testNode) writeSys(t *testing.T, name, attribute, value string) {
+	t.Helper()
+
+	dir := filepath.Join(n.dir, "sys", name)
+	if err := os.MkdirAll(dir, mkDirMode); err != nil {
+		t.Fatalf("cannot create %s: %v", dir, err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, attribute), []byte(value+"\n"), 0644); err != nil {
+		t.Fatalf("cannot write %s of %s: %v", attribute, name, err)
+	}
+}
+
+// mounts returns the mount points at target
+func (n *testNode) mounts(target string) []mount.MountPoint {
+	var mounts []mount.MountPoint
+	for _, mp := range n.mounter.MountPoints {
+		if mp.Path == target {
+			mounts = append(mounts, mp)
+		}
+	}
+	return mounts
+}
+
+func (n *testNode) publishContext(volumeID string) map[string]string {
+	return map[string]string{n.Driver.publishVolumeID: volumeID}
+}
+
+// formatOnMkfs makes blkid report a blank disk until mkfs creates a filesystem on it, and
+// the resize checks find the filesystem filling the disk of sizeBytes
+func (n *testNode) formatOnMkfs(sizeBytes int64) {
+	var format string
+	n.exec["blkid"] = func(args ...string) (string, error) {
+		return blkid(format)(args...)
+	}
+	for _, fsType := range supportedFsTypes {
+		n.exec["mkfs."+fsType] = func(args ...string) (string, error) {
+			format = "TYPE=" + fsType + "\n"
+			return "", nil
+		}
+	}
+	n.exec["blockdev"] = func(args ...string) (string, error) {
+		if args[0] == "--getro" {
+			return "0", nil
+		}
+		return strconv.FormatInt(sizeBytes, 10), nil
+	}
+	n.exec["dumpe2fs"] = func(args ...string) (string, error) {
+		return "Block count: " + strconv.FormatInt(sizeBytes/4096, 10) + "\nBlock size: 4096\n", nil
+	}
+}
+
+func mountVolumeCapability() *csi.VolumeCapability {
+	return &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+	}
+}
+
+func blockVolumeCapability() *csi.VolumeCapability {
+	return &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+	}
+}
+
+func checkCode(t *testing.T, err error, want codes.Code) {
+	t.Helper()
+
+	if got := status.Code(err); got != want {
+		t.Fatalf("got code %v, want %v (error: %v)", got, want, err)
+	}
+}
+
+func TestNodePublishBlockVolume(t *testing.T) {
+	node := newTestNode(t)
+	device := node.addDisk(t, "vdb", testVolumeID, giB)
+	target := filepath.Join(node.dir, "mnt", "pods", "volume")
+
+	req := &csi.NodePublishVolumeRequest{
+		VolumeId:          testVolumeID,
+		StagingTargetPath: filepath.Join(node.dir, "mnt", "staging"),
+		TargetPath:        target,
+		VolumeCapability:  blockVolumeCapability(),
+		PublishContext:    node.publishContext(testVolumeID),
+	}
+
+	_, err := node.NodePublishVolume(context.Background(), req)
+	checkCode(t, err, codes.OK)
+
+	if info, err := os.Stat(target); err != nil || info.IsDir() {
+		t.Fatalf("block volume target is not a file: %v", err)
+	}
+	mounts := node.mounts(target)
+	if len(mounts) != 1 || mounts[0].Device != device {
+		t.Fatalf("target mounts %+v, want a bind mount of %s", mounts, device)
+	}
+
+	// a repeated publish finds the bind mount in place
+	_, err = node.NodePublishVolume(context.Background(), req)
+	checkCode(t, err, codes.OK)
+	if mounts := node.mounts(target); len(mounts) != 1 {
+		t.Errorf("repeated publish left %d mounts at the target, want 1", len(mounts))
+	}
+
+	// the fake mounter doesn't bind the device onto the target, stand in for it
+	if err := os.Truncate(target, giB); err != nil {
+		t.Fatalf("cannot size target: %v", err)
+	}
+
+	res, err := node.NodeGetVolumeStats(context.Background(), &csi.NodeGetVolumeStatsRequest{VolumeId: testVolumeID, VolumePath: target})
+	checkCode(t, err, codes.OK)
+	if len(res.Usage) != 1 || res.Usage[0].Total != giB || res.Usage[0].Unit != csi.VolumeUsage_BYTES {
+		t.Errorf("block volume usage %v, want a total of %d bytes", res.Usage, giB)
+	}
+
+	_, err = node.NodeUnpublishVolume(context.Background(), &csi.NodeUnpublishVolumeRequest{VolumeId: testVolumeID, TargetPath: target})
+	checkCode(t, err, codes.OK)
+
+	if mounts := node.mounts(target); len(mounts) != 0 {
+		t.Errorf("target is still mounted after unpublish: %+v", mounts)
+	}
+	if _, err := os.Stat(target); !os.IsNotExist(err) {
+		t.Errorf("block volume target was not removed: %v", err)
+	}
+}
+
+// fakeStat stands in for unix.Stat with the device numbers of paths, a tmpdir holds no block device
+func fakeStat(stats map[string]unix.Stat_t) func(string, *unix.Stat_t) error {
+	return func(path string, st *unix.Stat_t) error {
+		found, ok := stats[path]
+		if !ok {
+			return os.ErrNotExist
+		}
+		*st = found
+		return nil
+	}
+}
+
+func TestNodePublishBlockVolumeMountedFromAnotherDevice(t *testing.T) {
+	node := newTestNode(t)
+	device := node.addDisk(t, "vdb", testVolumeID, giB)
+	target := filepath.Join(node.dir, "mnt", "pods", "volume")
+
+	req := &csi.NodePublishVolumeRequest{
+		VolumeId:          testVolumeID,
+		StagingTargetPath: filepath.Join(node.dir, "mnt", "staging"),
+		TargetPath:        target,
+		VolumeCapability:  blockVolumeCapability(),
+		PublishContext:    node.publishContext(testVolumeID),
+	}
+
+	_, err := node.NodePublishVolume(context.Background(), req)
+	checkCode(t, err, codes.OK)
+
+	// the device file bind mounted at the target is another disk than the one of the volume
+	node.stat = fakeStat(map[string]unix.Stat_t{
+		device: {Mode: unix.S_IFBLK, Rdev: unix.Mkdev(252, 16)},
+		target: {Mode: unix.S_IFBLK, Rdev: unix.Mkdev(252, 32)},
+	})
+	_, err = node.NodePublishVolume(context.Background(), req)
+	checkCode(t, err, codes.AlreadyExists)
+}
+
+func TestSameSource(t *testing.T) {
+	disk := unix.Mkdev(252, 16)
+	otherDisk := unix.Mkdev(252, 32)
+
+	tests := []struct {
+		name   string
+		source unix.Stat_t
+		target unix.Stat_t
+		want   bool
+	}{
+		{
+			name:   "device file bind mounted onto the target",
+			source: unix.Stat_t{Mode: unix.S_IFBLK, Rdev: disk},
+			target: unix.Stat_t{Mode: unix.S_IFBLK, Rdev: disk},
+			want:   true,
+		},
+		{
+			name:   "another device file bind mounted onto the target",
+			source: unix.Stat_t{Mode: unix.S_IFBLK, Rdev: disk},
+			target: unix.Stat_t{Mode: unix.S_IFBLK, Rdev: otherDisk},
+			want:   false,
+		},
+		{
+			name:   "device staged at the target",
+			source: unix.Stat_t{Mode: unix.S_IFBLK, Rdev: disk},
+			target: unix.Stat_t{Mode: unix.S_IFDIR, Dev: disk},
+			want:   true,
+		},
+		{
+			name:   "another device staged at the target",
+			source: unix.Stat_t{Mode: unix.S_IFBLK, Rdev: disk},
+			target: unix.Stat_t{Mode: unix.S_IFDIR, Dev: otherDisk},
+			want:   false,
+		},
+		{
+			name:   "staging directory bind mounted onto the target",
+			source: unix.Stat_t{Mode: unix.S_IFDIR, Dev: disk},
+			target: unix.Stat_t{Mode: unix.S_IFDIR, Dev: disk},
+			want:   true,
+		},
+		{
+			name:   "another directory bind mounted onto the target",
+			source: unix.Stat_t{Mode: unix.S_IFDIR, Dev: disk},
+			target: unix.Stat_t{Mode: unix.S_IFDIR, Dev: otherDisk},
+			want:   false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			node := newTestNode(t)
+			node.stat = fakeStat(map[string]unix.Stat_t{"/source": tt.source, "/target": tt.target})
+
+			got, err := node.sameSource("/source", "/target")
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("got %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNodeStageVolume(t *testing.T) {
+	node := newTestNode(t)
+	device := node.addDisk(t, "vdb", testVolumeID, giB)
+	node.formatOnMkfs(giB)
+	staging := filepath.Join(node.dir, "mnt", "staging")
+
+	req := &csi.NodeStageVolumeRequest{
+		VolumeId:          testVolumeID,
+		StagingTargetPath: staging,
+		VolumeCapability:  mountVolumeCapability(),
+		PublishContext:    node.publishContext(testVolumeID),
+	}
+
+	_, err := node.NodeStageVolume(context.Background(), req)
+	checkCode(t, err, codes.OK)
+
+	mounts := node.mounts(staging)
+	if len(mounts) != 1 || mounts[0].Device != device || mounts[0].Type != defaultFsType {
+		t.Fatalf("staging mounts %+v, want %s mounted with %s", mounts, device, defaultFsType)
+	}
+
+	// a repeated stage finds the volume mounted, and doesn't stack another mount
+	_, err = node.NodeStageVolume(context.Background(), req)
+	checkCode(t, err, codes.OK)
+	if mounts := node.mounts(staging); len(mounts) != 1 {
+		t.Errorf("repeated stage left %d mounts at the staging path, want 1", len(mounts))
+	}
+
+	_, err = node.NodeUnstageVolume(context.Background(), &csi.NodeUnstageVolumeRequest{VolumeId: testVolumeID, StagingTargetPath: staging})
+	checkCode(t, err, codes.OK)
+	if mounts := node.mounts(staging); len(mounts) != 0 {
+		t.Errorf("staging path is still mounted after unstage: %+v", mounts)
+	}
+
+	// unstaging again is a no-op
+	_, err = node.NodeUnstageVolume(context.Background(), &csi.NodeUnstageVolumeRequest{VolumeId: testVolumeID, StagingTargetPath: staging})
+	checkCode(t, err, codes.OK)
+}
+
+func TestNodePublishVolume(t *testing.T) {
+	tests := []struct {
+		name     string
+		mounted  []string
+		readonly bool
+		code     codes.Code
+	}{
+		{
+			name: "bind mounts the staging path",
+			code: codes.OK,
+		},
+		{
+			name:    "does nothing when already published",
+			mounted: []string{"bind"},
+			code:    codes.OK,
+		},
+		{
+			name:     "refuses a read-only publish over a read-write one",
+			mounted:  []string{"bind"},
+			readonly: true,
+			code:     codes.AlreadyExists,
+		},
+		{
+			name:    "refuses a read-write publish over a read-only one",
+			mounted: []string{"bind", "ro"},
+			code:    codes.AlreadyExists,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			node := newTestNode(t)
+			staging := filepath.Join(node.dir, "mnt", "staging")
+			target := filepath.Join(node.dir, "mnt", "pods", "volume")
+			if err := os.MkdirAll(staging, mkDirMode); err != nil {
+				t.Fatalf("cannot create staging path: %v", err)
+			}
+
+			if tt.mounted != nil {
+				if err := os.MkdirAll(target, mkDirMode); err != nil {
+					t.Fatalf("cannot create target: %v", err)
+				}
+				node.mounter.MountPoints = append(node.mounter.MountPoints, mount.MountPoint{Device: staging, Path: target, Opts: tt.mounted})
+			}
+
+			_, err := node.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+				VolumeId:          testVolumeID,
+				StagingTargetPath: staging,
+				TargetPath:        target,
+				VolumeCapability:  mountVolumeCapability(),
+				Readonly:          tt.readonly,
+			})
+			checkCode(t, err, tt.code)
+
+			if mounts := node.mounts(target); len(mounts) != 1 {
+				t.Errorf("got %d mounts at the target, want 1", len(mounts))
+			}
+		})
+	}
+}
+
+func TestNodePrivateMounts(t *testing.T) {
+	node := newTestNode(t)
+	device := node.addDisk(t, "vdb", testVolumeID, giB)
+	staging := filepath.Join(node.dir, "mnt", "staging")
+	target := filepath.Join(node.dir, "mnt", "pods", "volume")
+	for _, dir := range []string{staging, target} {
+		if err := os.MkdirAll(dir, mkDirMode); err != nil {
+			t.Fatalf("cannot create %s: %v", dir, err)
+		}
+	}
+
+	node.mounter.MountPoints = []mount.MountPoint{
+		{Device: device, Path: staging, Type: defaultFsType},
+		{Device: device, Path: target, Type: defaultFsType, Opts: []string{"bind"}},
+	}
+	// neither mount is shared, e.g. kubelet running without mount propagation
+	node.Driver.mounter.Interface = &mountInfoMounter{
+		FakeMounter: node.mounter,
+		infos: []mount.MountInfo{
+			{MountPoint: staging, OptionalFields: []string{}},
+			{MountPoint: target, OptionalFields: []string{"master:1"}},
+		},
+	}
+
+	res, err := node.NodeGetVolumeStats(context.Background(), &csi.NodeGetVolumeStatsRequest{VolumeId: testVolumeID, VolumePath: target})
+	checkCode(t, err, codes.OK)
+	if len(res.Usage) != 2 || res.Usage[0].Total == 0 {
+		t.Errorf("usage %v, want the bytes and inodes of the filesystem", res.Usage)
+	}
+
+	warned := false
+	for _, entry := range node.logs.AllEntries() {
+		if entry.Level == logrus.WarnLevel && entry.Message == "mount propagation is not shared" {
+			warned = true
+		}
+	}
+	if !warned {
+		t.Error("no warning about the private mount")
+	}
+
+	_, err = node.NodeUnpublishVolume(context.Background(), &csi.NodeUnpublishVolumeRequest{VolumeId: testVolumeID, TargetPath: target})
+	checkCode(t, err, codes.OK)
+	if mounts := node.mounts(target); len(mounts) != 0 {
+		t.Errorf("private target mount is left after unpublish: %+v", mounts)
+	}
+
+	_, err = node.NodeUnstageVolume(context.Background(), &csi.NodeUnstageVolumeRequest{VolumeId: testVolumeID, StagingTargetPath: staging})
+	checkCode(t, err, codes.OK)
+	if mounts := node.mounts(staging); len(mounts) != 0 {
+		t.Errorf("private staging mount is left after unstage: %+v", mounts)
+	}
+}
+
+func TestNodeGetVolumeStatsOfAnUnmountedPath(t *testing.T) {
+	node := newTestNode(t)
+
+	_, err := node.NodeGetVolumeStats(context.Background(), &csi.NodeGetVolumeStatsRequest{VolumeId: testVolumeID, VolumePath: node.dir})
+	checkCode(t, err, codes.NotFound)
+}
+
+func TestNodeExpandVolume(t *testing.T) {
+	node := newTestNode(t)
+	device := node.addDisk(t, "vdb", testVolumeID, 2*giB)
+	target := filepath.Join(node.dir, "mnt", "staging")
+	node.mounter.MountPoints = []mount.MountPoint{{Device: device, Path: target, Type: defaultFsType}}
+
+	node.exec["blkid"] = blkid("TYPE=ext4\n")
+	var resized []string
+	node.exec["resize2fs"] = func(args ...string) (string, error) {
+		resized = args
+		return "", nil
+	}
+
+	res, err := node.NodeExpandVolume(context.Background(), &csi.NodeExpandVolumeRequest{
+		VolumeId:         testVolumeID,
+		VolumePath:       target,
+		VolumeCapability: mountVolumeCapability(),
+		CapacityRange:    &csi.CapacityRange{RequiredBytes: 2 * giB},
+	})
+	checkCode(t, err, codes.OK)
+
+	if len(resized) != 1 || resized[0] != device {
+		t.Errorf("resize2fs ran with %v, want the device %s found through the mounter", resized, device)
+	}
+	if res.CapacityBytes != 2*giB {
+		t.Errorf("capacity %d, want %d", res.CapacityBytes, 2*giB)
+	}
+}
+
+func TestNodeStageBlockVolume(t *testing.T) {
+	node := newTestNode(t)
+
+	_, err := node.NodeStageVolume(context.Background(), &csi.NodeStageVolumeRequest{
+		VolumeId:          testVolumeID,
+		StagingTargetPath: filepath.Join(node.dir, "mnt", "staging"),
+		VolumeCapability:  blockVolumeCapability(),
+		PublishContext:    node.publishContext(testVolumeID),
+	})
+	checkCode(t, err, codes.OK)
+
+	if len(node.mounter.MountPoints) != 0 {
+		t.Errorf("staging a block volume mounted %+v", node.mounter.MountPoints)
+	}
+}
+
+func TestStageFsType(t *testing.T) {
+	mountCapability := func(fsType string) *csi.VolumeCapability {
+		return &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{FsType: fsType}},
+		}
+	}
+
+	tests := []struct {
+		name string
+		req  *csi.NodeStageVolumeRequest
+		want string
+	}{
+		{
+			name: "storage class parameter wins over the provisioner default",
+			req: &csi.NodeStageVolumeRequest{
+				VolumeCapability: mountCapability("ext4"),
+				VolumeContext:    map[string]string{paramFsType: "xfs"},
+			},
+			want: "xfs",
+		},
+		{
+			name: "volume capability without a storage class parameter",
+			req:  &csi.NodeStageVolumeRequest{VolumeCapability: mountCapability("xfs")},
+			want: "xfs",
+		},
+		{
+			name: "default without either",
+			req:  &csi.NodeStageVolumeRequest{VolumeCapability: mountCapability("")},
+			want: defaultFsType,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := stageFsType(tt.req); got != tt.want {
+				t.Errorf("got fsType %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckDeviceBeforeFormat(t *testing.T) {
+	tests := []struct {
+		name   string
+		setup  func(*testing.T, *testNode, string)
+		blkid  string
+		fsType string
+		code   codes.Code
+	}{
+		{
+			name:   "formats a blank disk",
+			fsType: "ext4",
+			code:   codes.OK,
+		},
+		{
+			name:   "mounts a disk with the requested filesystem",
+			blkid:  "DEVNAME=/dev/vdb\nTYPE=ext4\n",
+			fsType: "ext4",
+			code:   codes.OK,
+		},
+		{
+			name:   "refuses a disk with another filesystem",
+			blkid:  "DEVNAME=/dev/vdb\nTYPE=xfs\n",
+			fsType: "ext4",
+			code:   codes.FailedPrecondition,
+		},
+		{
+			name:   "refuses a disk with a partition table",
+			blkid:  "DEVNAME=/dev/vdb\nPTTYPE=dos\n",
+			fsType: "ext4",
+			code:   codes.FailedPrecondition,
+		},
+		{
+			name: "refuses the disk of another volume",
+			setup: func(t *testing.T, node *testNode, _ string) {
+				node.writeSys(t, "vdb", "serial", serialPrefix+"vol-2")
+			},
+			fsType: "ext4",
+			code:   codes.FailedPrecondition,
+		},
+		{
+			name: "refuses a disk without a serial",
+			setup: func(t *testing.T, node *testNode, _ string) {
+				if err := os.Remove(filepath.Join(node.dir, "sys", "vdb", "serial")); err != nil {
+					t.Fatalf("cannot remove serial: %v", err)
+				}
+			},
+			fsType: "ext4",
+			code:   codes.FailedPrecondition,
+		},
+		{
+			name: "refuses a disk held by another device",
+			setup: func(t *testing.T, node *testNode, _ string) {
+				if err := os.MkdirAll(filepath.Join(node.dir, "sys", "vdb", "holders", "dm-0"), mkDirMode); err != nil {
+					t.Fatalf("cannot add holder: %v", err)
+				}
+			},
+			fsType: "ext4",
+			code:   codes.FailedPrecondition,
+		},
+		{
+			name: "refuses a disk mounted elsewhere",
+			setup: func(t *testing.T, node *testNode, device string) {
+				node.mounter.MountPoints = append(node.mounter.MountPoints, mount.MountPoint{Device: device, Path: "/var/lib/other"})
+			},
+			fsType: "ext4",
+			code:   codes.FailedPrecondition,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			node := newTestNode(t)
+			device := node.addDisk(t, "vdb", testVolumeID, giB)
+			node.exec["blkid"] = blkid(tt.blkid)
+			if tt.setup != nil {
+				tt.setup(t, node, device)
+			}
+
+			err := node.checkDeviceBeforeFormat(testVolumeID, device, filepath.Join(node.dir, "mnt", "staging"), tt.fsType)
+			checkCode(t, err, tt.code)
+		})
+	}
+}
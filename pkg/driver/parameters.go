@@ -0,0 +1,193 @@
+package driver
+
+import (
+	"strconv"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// StorageClass parameters understood by CreateVolume
+const (
+	paramDiskType   = "type"
+	paramIops       = "iops"
+	paramThroughput = "throughput"
+	paramDcslug     = "dcslug"
+	paramFsType     = "fsType"
+)
+
+const (
+	diskTypeSSD  = "SSD"
+	diskTypeHDD  = "HDD"
+	diskTypeNVMe = "NVMe"
+
+	defaultDiskType = diskTypeSSD
+	defaultFsType   = "ext4"
+
+	// defaultIops and defaultThroughput (MB/s) are used when the StorageClass sets
+	// neither, they are the settings of the volume in the EBS responses recorded by
+	// utho-go. The range each disk type allows is left to the Utho API to enforce
+	defaultIops       = 3000
+	defaultThroughput = 125
+)
+
+var (
+	diskTypes = []string{diskTypeHDD, diskTypeNVMe, diskTypeSSD}
+
+	supportedFsTypes = []string{"ext3", "ext4", "xfs"}
+)
+
+// volumeParameters is the validated form of the StorageClass parameters of a volume
+type volumeParameters struct {
+	diskType   string
+	iops       int
+	throughput int
+	dcslug     string
+	fsType     string
+}
+
+// parseVolumeParameters validates the StorageClass parameters and fills in the
+// defaults of the requested disk type. Mutable parameters from a VolumeAttributesClass
+// override the StorageClass ones. Unknown keys are rejected
+func parseVolumeParameters(params, mutableParams map[string]string) (*volumeParameters, error) {
+	if err := checkParameterKeys("StorageClass", params, paramDiskType, paramIops, paramThroughput, paramDcslug, paramFsType); err != nil {
+		return nil, err
+	}
+	if err := checkParameterKeys("VolumeAttributesClass", mutableParams, paramIops, paramThroughput); err != nil {
+		return nil, err
+	}
+
+	vp := &volumeParameters{
+		diskType: defaultDiskType,
+		dcslug:   params[paramDcslug],
+	}
+
+	if diskType := params[paramDiskType]; diskType != "" {
+		normalized, ok := normalizeDiskType(diskType)
+		if !ok {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid StorageClass parameter %q: unsupported disk type %q, supported types are %s",
+				paramDiskType, diskType, strings.Join(diskTypes, ", "))
+		}
+		vp.diskType = normalized
+	}
+
+	if fsType := params[paramFsType]; fsType != "" {
+		if !isSupportedFsType(fsType) {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid StorageClass parameter %q: unsupported filesystem %q, supported filesystems are %s",
+				paramFsType, fsType, strings.Join(supportedFsTypes, ", "))
+		}
+		vp.fsType = fsType
+	}
+
+	vp.iops = defaultIops
+	vp.throughput = defaultThroughput
+
+	if err := vp.parsePerformance("StorageClass", params); err != nil {
+		return nil, err
+	}
+	if err := vp.parsePerformance("VolumeAttributesClass", mutableParams); err != nil {
+		return nil, err
+	}
+
+	return vp, nil
+}
+
+// parseMutableParameters validates the VolumeAttributesClass parameters of an existing
+// volume. Only the parameters that are set are filled in
+func parseMutableParameters(mutableParams map[string]string) (*volumeParameters, error) {
+	if err := checkParameterKeys("VolumeAttributesClass", mutableParams, paramIops, paramThroughput); err != nil {
+		return nil, err
+	}
+
+	vp := &volumeParameters{}
+	if err := vp.parsePerformance("VolumeAttributesClass", mutableParams); err != nil {
+		return nil, err
+	}
+
+	return vp, nil
+}
+
+// parsePerformance parses the iops and throughput parameters
+func (vp *volumeParameters) parsePerformance(kind string, params map[string]string) error {
+	var err error
+	if value, ok := params[paramIops]; ok {
+		if vp.iops, err = parsePositiveInt(kind, paramIops, value); err != nil {
+			return err
+		}
+	}
+
+	if value, ok := params[paramThroughput]; ok {
+		if vp.throughput, err = parsePositiveInt(kind, paramThroughput, value); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// checkParameterKeys rejects any parameter that isn't one of the supported keys
+func checkParameterKeys(kind string, params map[string]string, supported ...string) error {
+	for key := range params {
+		found := false
+		for _, s := range supported {
+			if key == s {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return status.Errorf(codes.InvalidArgument, "invalid %s parameter %q, supported parameters are %s",
+				kind, key, strings.Join(supported, ", "))
+		}
+	}
+
+	return nil
+}
+
+// volumeContext is passed to the node service with every volume, it carries the filesystem
+// of the StorageClass, which takes precedence over the default the CO sets on the volume
+// capability
+func volumeContext(vp *volumeParameters) map[string]string {
+	if vp.fsType == "" {
+		return nil
+	}
+
+	return map[string]string{
+		paramFsType: vp.fsType,
+	}
+}
+
+// parsePositiveInt parses an integer parameter that must be above zero
+func parsePositiveInt(kind, key, value string) (int, error) {
+	parsed, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil {
+		return 0, status.Errorf(codes.InvalidArgument, "invalid %s parameter %q: %q is not an integer", kind, key, value)
+	}
+
+	if parsed <= 0 {
+		return 0, status.Errorf(codes.InvalidArgument, "invalid %s parameter %q: %d is not positive", kind, key, parsed)
+	}
+
+	return parsed, nil
+}
+
+// normalizeDiskType matches the disk type case-insensitively against the types Utho offers
+func normalizeDiskType(diskType string) (string, bool) {
+	for _, name := range diskTypes {
+		if strings.EqualFold(name, diskType) {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+func isSupportedFsType(fsType string) bool {
+	for _, supported := range supportedFsTypes {
+		if fsType == supported {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,100 @@
+package driver
+
+import (
+	"context"
+
+	"github.com/uthoplatforms/utho-go/utho"
+)
+
+// BlockStorage is the block storage backend the controller manages volumes through.
+// Calls are bound to the context of the RPC they are made for, errors are classified
+// like the ones of the Utho API, see classifyUthoError
+type BlockStorage interface {
+	CreateVolume(ctx context.Context, params CreateVolumeParams) (string, error)
+	GetVolume(ctx context.Context, volumeID string) (*Volume, error)
+	ListVolumes(ctx context.Context) ([]Volume, error)
+	DeleteVolume(ctx context.Context, volumeID string) error
+
+	// AttachVolume and DetachVolume return once the request is accepted, the
+	// volume's Cloudid changes when the operation completes
+	AttachVolume(ctx context.Context, volumeID, nodeID string) error
+	DetachVolume(ctx context.Context, volumeID, nodeID string) error
+
+	// ResizeVolume sets the size, iops and throughput of the volume, the API takes them together
+	ResizeVolume(ctx context.Context, volumeID string, params ResizeVolumeParams) error
+
+	CreateSnapshot(ctx context.Context, volumeID, name string) (string, error)
+	ListSnapshots(ctx context.Context) ([]Snapshot, error)
+	DeleteSnapshot(ctx context.Context, volumeID, snapshotID string) error
+
+	ListQuotas(ctx context.Context) ([]Quota, error)
+}
+
+var _ BlockStorage = &uthoBlockStorage{}
+
+// uthoBlockStorage is the BlockStorage of a Utho account
+type uthoBlockStorage struct {
+	client utho.Client
+}
+
+func newUthoBlockStorage(client utho.Client) *uthoBlockStorage {
+	return &uthoBlockStorage{client: client}
+}
+
+func (s *uthoBlockStorage) CreateVolume(ctx context.Context, params CreateVolumeParams) (string, error) {
+	res, err := createEBS(ctx, s.client, params)
+	if err != nil {
+		return "", err
+	}
+	return res.ID, nil
+}
+
+func (s *uthoBlockStorage) GetVolume(ctx context.Context, volumeID string) (*Volume, error) {
+	return readEBS(ctx, s.client, volumeID)
+}
+
+func (s *uthoBlockStorage) ListVolumes(ctx context.Context) ([]Volume, error) {
+	return listEBS(ctx, s.client)
+}
+
+func (s *uthoBlockStorage) DeleteVolume(ctx context.Context, volumeID string) error {
+	return deleteEBS(ctx, s.client, volumeID)
+}
+
+func (s *uthoBlockStorage) AttachVolume(ctx context.Context, volumeID, nodeID string) error {
+	return attachEBS(ctx, s.client, volumeID, attachEBSParams{
+		ResourceID: nodeID,
+		Type:       "cloud",
+	})
+}
+
+func (s *uthoBlockStorage) DetachVolume(ctx context.Context, volumeID, nodeID string) error {
+	return detachEBS(ctx, s.client, volumeID, attachEBSParams{
+		ResourceID: nodeID,
+		Type:       "cloud",
+	})
+}
+
+func (s *uthoBlockStorage) ResizeVolume(ctx context.Context, volumeID string, params ResizeVolumeParams) error {
+	return resizeEBS(ctx, s.client, volumeID, params)
+}
+
+func (s *uthoBlockStorage) CreateSnapshot(ctx context.Context, volumeID, name string) (string, error) {
+	res, err := createEBSSnapshot(ctx, s.client, volumeID, createEBSSnapshotParams{Name: name})
+	if err != nil {
+		return "", err
+	}
+	return res.ID, nil
+}
+
+func (s *uthoBlockStorage) ListSnapshots(ctx context.Context) ([]Snapshot, error) {
+	return listEBSSnapshots(ctx, s.client)
+}
+
+func (s *uthoBlockStorage) DeleteSnapshot(ctx context.Context, volumeID, snapshotID string) error {
+	return deleteEBSSnapshot(ctx, s.client, volumeID, snapshotID)
+}
+
+func (s *uthoBlockStorage) ListQuotas(ctx context.Context) ([]Quota, error) {
+	return listEBSQuotas(ctx, s.client)
+}
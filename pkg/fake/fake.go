@@ -0,0 +1,747 @@
+// Package fake provides an in-memory Utho cloud to run the CSI controller against
+// without an account. It models EBS volumes and snapshots, attachments with the
+// "0" cloudid of a detached volume, per datacenter quotas and Kubernetes clusters
+// with their nodepools. Failures and latency can be injected per operation.
+package fake
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/uthoplatforms/csi-utho/pkg/driver"
+	"github.com/uthoplatforms/utho-go/utho"
+)
+
+// Operations failures can be injected into
+const (
+	OpCreateVolume   = "CreateVolume"
+	OpGetVolume      = "GetVolume"
+	OpListVolumes    = "ListVolumes"
+	OpDeleteVolume   = "DeleteVolume"
+	OpAttachVolume   = "AttachVolume"
+	OpDetachVolume   = "DetachVolume"
+	OpResizeVolume   = "ResizeVolume"
+	OpCreateSnapshot = "CreateSnapshot"
+	OpListSnapshots  = "ListSnapshots"
+	OpDeleteSnapshot = "DeleteSnapshot"
+	OpListQuotas     = "ListQuotas"
+)
+
+const (
+	// DetachedCloudID is the cloudid Utho reports for a volume that isn't attached
+	DetachedCloudID = "0"
+
+	// TimeLayout is the timestamp format used by the Utho API
+	TimeLayout = "2006-01-02 15:04:05"
+
+	statusActive  = "Active"
+	statusPending = "Pending"
+)
+
+var (
+	_ driver.BlockStorage = &Cloud{}
+	_ driver.Clusters     = &Cloud{}
+)
+
+// Cloud is an in-memory Utho account. The zero value is not usable, use NewCloud
+type Cloud struct {
+	mu sync.Mutex
+
+	nextID    int
+	volumes   map[string]*driver.Volume
+	snapshots map[string]*driver.Snapshot
+	quotas    map[string]int
+	clusters  map[string]*Cluster
+
+	latency      time.Duration
+	errors       map[string]error
+	errorsOnce   map[string][]error
+	holdAttach   bool
+	attaching    map[string]string
+	diskTypes    map[string]string
+	snapshotHold bool
+	restoreHold  bool
+	calls        map[string]int
+}
+
+// Cluster is a Utho Kubernetes cluster
+type Cluster struct {
+	ID        string
+	Dcslug    string
+	Nodepools map[string]*Nodepool
+}
+
+// Nodepool is a group of workers of a cluster
+type Nodepool struct {
+	ID      string
+	Workers []Worker
+}
+
+// Worker is a node of a nodepool, Cloudid is the ID volumes are attached to
+type Worker struct {
+	Hostname string
+	Cloudid  string
+}
+
+// NewCloud returns an empty account
+func NewCloud() *Cloud {
+	return &Cloud{
+		nextID:     1000,
+		volumes:    map[string]*driver.Volume{},
+		snapshots:  map[string]*driver.Snapshot{},
+		quotas:     map[string]int{},
+		clusters:   map[string]*Cluster{},
+		errors:     map[string]error{},
+		errorsOnce: map[string][]error{},
+		attaching:  map[string]string{},
+		diskTypes:  map[string]string{},
+		calls:      map[string]int{},
+	}
+}
+
+// APIError returns the error utho-go reports for a response with the given HTTP status
+func APIError(statusCode int, message string) error {
+	return &utho.ErrorResponse{
+		Response: &http.Response{
+			StatusCode: statusCode,
+			Request: &http.Request{
+				Method: http.MethodGet,
+				URL:    &url.URL{Scheme: "https", Host: "api.utho.com", Path: "/v2/"},
+			},
+		},
+		Errors: []utho.Error{{Message: message}},
+	}
+}
+
+// apiMessage returns the error utho-go reports for a "status": "error" response
+func apiMessage(message string) error {
+	return &driver.UthoError{Message: message}
+}
+
+// SetLatency delays every call by d
+func (c *Cloud) SetLatency(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.latency = d
+}
+
+// SetError makes every call of op fail with err, a nil err clears it
+func (c *Cloud) SetError(op string, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err == nil {
+		delete(c.errors, op)
+		return
+	}
+	c.errors[op] = err
+}
+
+// FailOnce makes the next call of op fail with err. Repeated calls queue up
+func (c *Cloud) FailOnce(op string, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.errorsOnce[op] = append(c.errorsOnce[op], err)
+}
+
+// Calls returns how many times op was called, failed calls included
+func (c *Cloud) Calls(op string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.calls[op]
+}
+
+// HoldAttachments leaves attach and detach requests in progress until
+// ReleaseAttachments is called, like a slow API would. The API doesn't report them,
+// the cloudid of the volume only changes once they complete
+func (c *Cloud) HoldAttachments() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.holdAttach = true
+}
+
+// ReleaseAttachments completes the attach and detach requests in progress
+func (c *Cloud) ReleaseAttachments() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.holdAttach = false
+	for volumeID, cloudID := range c.attaching {
+		if volume, ok := c.volumes[volumeID]; ok {
+			volume.Cloudid = cloudID
+		}
+		delete(c.attaching, volumeID)
+	}
+}
+
+// HoldSnapshots leaves new snapshots pending until ReleaseSnapshots is called
+func (c *Cloud) HoldSnapshots() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.snapshotHold = true
+}
+
+// ReleaseSnapshots makes every pending snapshot ready to use
+func (c *Cloud) ReleaseSnapshots() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.snapshotHold = false
+	for _, snapshot := range c.snapshots {
+		snapshot.Status = statusActive
+	}
+}
+
+// HoldRestores leaves volumes created from a snapshot pending until ReleaseRestores is called
+func (c *Cloud) HoldRestores() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.restoreHold = true
+}
+
+// ReleaseRestores completes the restores in progress
+func (c *Cloud) ReleaseRestores() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.restoreHold = false
+	for _, volume := range c.volumes {
+		if volume.Status == statusPending {
+			volume.Status = statusActive
+		}
+	}
+}
+
+// SetQuota limits the block storage of the account in the datacenter to limitGB
+func (c *Cloud) SetQuota(dcslug string, limitGB int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.quotas[dcslug] = limitGB
+}
+
+// AddCluster adds a Kubernetes cluster in the datacenter
+func (c *Cloud) AddCluster(id, dcslug string) *Cluster {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cluster := &Cluster{ID: id, Dcslug: dcslug, Nodepools: map[string]*Nodepool{}}
+	c.clusters[id] = cluster
+	return cluster
+}
+
+// AddNodepool adds a nodepool with the given workers to the cluster
+func (c *Cloud) AddNodepool(clusterID, nodepoolID string, workers ...Worker) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cluster, ok := c.clusters[clusterID]
+	if !ok {
+		return APIError(http.StatusNotFound, "Kubernetes cluster not found")
+	}
+
+	cluster.Nodepools[nodepoolID] = &Nodepool{ID: nodepoolID, Workers: workers}
+	return nil
+}
+
+// NodeID implements driver.Clusters
+func (c *Cloud) NodeID(clusterID, nodepoolID, hostname string) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cluster, ok := c.clusters[clusterID]
+	if !ok {
+		return "", APIError(http.StatusNotFound, "Kubernetes cluster not found")
+	}
+
+	nodepool, ok := cluster.Nodepools[nodepoolID]
+	if !ok {
+		return "", fmt.Errorf("nodepool %s not found in cluster %s", nodepoolID, clusterID)
+	}
+
+	for _, worker := range nodepool.Workers {
+		if strings.EqualFold(worker.Hostname, hostname) {
+			return worker.Cloudid, nil
+		}
+	}
+
+	return "", fmt.Errorf("node %s not found in nodepool %s", hostname, nodepoolID)
+}
+
+// Dcslug implements driver.Clusters
+func (c *Cloud) Dcslug(clusterID string) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cluster, ok := c.clusters[clusterID]
+	if !ok {
+		return "", APIError(http.StatusNotFound, "Kubernetes cluster not found")
+	}
+	return cluster.Dcslug, nil
+}
+
+// AddVolume stores a volume as is, e.g. one created outside the driver
+func (c *Cloud) AddVolume(volume driver.Volume) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if volume.ID == "" {
+		volume.ID = c.newID()
+	}
+	if volume.Cloudid == "" {
+		volume.Cloudid = DetachedCloudID
+	}
+	if volume.Status == "" {
+		volume.Status = statusActive
+	}
+	c.volumes[volume.ID] = &volume
+	return volume.ID
+}
+
+// Volume returns a copy of the volume
+func (c *Cloud) Volume(volumeID string) (driver.Volume, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	volume, ok := c.volumes[volumeID]
+	if !ok {
+		return driver.Volume{}, false
+	}
+	return *volume, true
+}
+
+// DiskType returns the disk type the volume was created with, the API doesn't return it
+func (c *Cloud) DiskType(volumeID string) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.diskTypes[volumeID]
+}
+
+// AddSnapshot stores a snapshot as is
+func (c *Cloud) AddSnapshot(snapshot driver.Snapshot) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if snapshot.ID == "" {
+		snapshot.ID = c.newID()
+	}
+	if snapshot.Status == "" {
+		snapshot.Status = statusActive
+	}
+	if snapshot.CreatedAt == "" {
+		snapshot.CreatedAt = time.Now().UTC().Format(TimeLayout)
+	}
+	c.snapshots[snapshot.ID] = &snapshot
+	return snapshot.ID
+}
+
+// CreateVolume implements driver.BlockStorage
+func (c *Cloud) CreateVolume(ctx context.Context, params driver.CreateVolumeParams) (string, error) {
+	if err := c.call(ctx, OpCreateVolume); err != nil {
+		return "", err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	size, err := strconv.Atoi(params.Disk)
+	if err != nil || size <= 0 {
+		return "", apiMessage("disk must be a positive number of GB")
+	}
+
+	if params.SnapshotID != "" {
+		snapshot, ok := c.snapshots[params.SnapshotID]
+		if !ok {
+			return "", apiMessage("snapshot not found")
+		}
+		if snapshot.Status != statusActive {
+			return "", apiMessage("snapshot is not ready")
+		}
+		if snapshotSize, _ := strconv.Atoi(snapshot.Size); size < snapshotSize {
+			return "", apiMessage("disk must be at least the size of the snapshot")
+		}
+	}
+
+	if limit, ok := c.quotas[params.Dcslug]; ok && c.usedGB(params.Dcslug)+size > limit {
+		return "", apiMessage("block storage quota exceeded")
+	}
+
+	status := statusActive
+	if params.SnapshotID != "" && c.restoreHold {
+		status = statusPending
+	}
+
+	id := c.newID()
+	c.volumes[id] = &driver.Volume{
+		Ebs: utho.Ebs{
+			ID:         id,
+			Cloudid:    DetachedCloudID,
+			Size:       params.Disk,
+			Status:     status,
+			Name:       params.Name,
+			Iops:       params.Iops,
+			Throughput: params.Throughput,
+			CreatedAt:  time.Now().UTC().Format(TimeLayout),
+			Location:   utho.Location{Dc: params.Dcslug},
+		},
+	}
+	c.diskTypes[id] = params.DiskType
+
+	return id, nil
+}
+
+// GetVolume implements driver.BlockStorage
+func (c *Cloud) GetVolume(ctx context.Context, volumeID string) (*driver.Volume, error) {
+	var volume *driver.Volume
+	err := c.read(ctx, OpGetVolume, func() {
+		if found, ok := c.volumes[volumeID]; ok {
+			copied := *found
+			volume = &copied
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if volume == nil {
+		return nil, apiMessage("NotFound")
+	}
+	return volume, nil
+}
+
+// ListVolumes implements driver.BlockStorage
+func (c *Cloud) ListVolumes(ctx context.Context) ([]driver.Volume, error) {
+	var volumes []driver.Volume
+	err := c.read(ctx, OpListVolumes, func() {
+		volumes = make([]driver.Volume, 0, len(c.volumes))
+		for _, volume := range c.volumes {
+			volumes = append(volumes, *volume)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// the API has no ordering guarantee, don't let tests depend on map order either
+	sort.Slice(volumes, func(i, j int) bool {
+		return volumes[i].ID > volumes[j].ID
+	})
+
+	return volumes, nil
+}
+
+// DeleteVolume implements driver.BlockStorage
+func (c *Cloud) DeleteVolume(ctx context.Context, volumeID string) error {
+	if err := c.call(ctx, OpDeleteVolume); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	volume, ok := c.volumes[volumeID]
+	if !ok {
+		return APIError(http.StatusNotFound, "Block storage not found")
+	}
+	if volume.Cloudid != DetachedCloudID {
+		return apiMessage("Block storage volume is attached to a server, detach it first")
+	}
+
+	delete(c.volumes, volumeID)
+	delete(c.diskTypes, volumeID)
+	return nil
+}
+
+// AttachVolume implements driver.BlockStorage
+func (c *Cloud) AttachVolume(ctx context.Context, volumeID, nodeID string) error {
+	if err := c.call(ctx, OpAttachVolume); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	volume, ok := c.volumes[volumeID]
+	if !ok {
+		return APIError(http.StatusNotFound, "Block storage not found")
+	}
+	if len(c.clusters) > 0 && !c.hasNode(nodeID) {
+		return APIError(http.StatusNotFound, "Cloud server not found")
+	}
+	if _, ok := c.attaching[volumeID]; ok || volume.Cloudid != DetachedCloudID || volume.Status != statusActive {
+		return apiMessage("Block storage volume is already attached to a server")
+	}
+
+	if c.holdAttach {
+		c.attaching[volumeID] = nodeID
+		return nil
+	}
+
+	volume.Cloudid = nodeID
+	return nil
+}
+
+// DetachVolume implements driver.BlockStorage
+func (c *Cloud) DetachVolume(ctx context.Context, volumeID, nodeID string) error {
+	if err := c.call(ctx, OpDetachVolume); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	volume, ok := c.volumes[volumeID]
+	if !ok {
+		return APIError(http.StatusNotFound, "Block storage not found")
+	}
+	if volume.Cloudid == DetachedCloudID {
+		return apiMessage("Block storage volume is not currently attached to a server")
+	}
+	if volume.Cloudid != nodeID {
+		return apiMessage("Block storage volume is attached to a different server")
+	}
+	if _, ok := c.attaching[volumeID]; ok {
+		return apiMessage("Block storage volume is already being detached")
+	}
+
+	if c.holdAttach {
+		c.attaching[volumeID] = DetachedCloudID
+		return nil
+	}
+
+	volume.Cloudid = DetachedCloudID
+	return nil
+}
+
+// ResizeVolume implements driver.BlockStorage
+func (c *Cloud) ResizeVolume(ctx context.Context, volumeID string, params driver.ResizeVolumeParams) error {
+	if err := c.call(ctx, OpResizeVolume); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	volume, ok := c.volumes[volumeID]
+	if !ok {
+		return APIError(http.StatusNotFound, "Block storage not found")
+	}
+
+	sizeGB, err := strconv.Atoi(params.Disk)
+	if err != nil || sizeGB <= 0 {
+		return apiMessage("disk must be a positive number of GB")
+	}
+
+	current, _ := strconv.Atoi(volume.Size)
+	if sizeGB < current {
+		return apiMessage("disk must be larger than the current size")
+	}
+	if limit, ok := c.quotas[volume.Location.Dc]; ok && c.usedGB(volume.Location.Dc)-current+sizeGB > limit {
+		return apiMessage("block storage quota exceeded")
+	}
+
+	volume.Size = params.Disk
+	if params.Iops != "" {
+		volume.Iops = params.Iops
+	}
+	if params.Throughput != "" {
+		volume.Throughput = params.Throughput
+	}
+	return nil
+}
+
+// CreateSnapshot implements driver.BlockStorage
+func (c *Cloud) CreateSnapshot(ctx context.Context, volumeID, name string) (string, error) {
+	if err := c.call(ctx, OpCreateSnapshot); err != nil {
+		return "", err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	volume, ok := c.volumes[volumeID]
+	if !ok {
+		return "", APIError(http.StatusNotFound, "Block storage not found")
+	}
+
+	status := statusActive
+	if c.snapshotHold {
+		status = statusPending
+	}
+
+	id := c.newID()
+	c.snapshots[id] = &driver.Snapshot{
+		ID:        id,
+		EbsID:     volumeID,
+		Name:      name,
+		Size:      volume.Size,
+		Status:    status,
+		CreatedAt: time.Now().UTC().Format(TimeLayout),
+	}
+
+	return id, nil
+}
+
+// ListSnapshots implements driver.BlockStorage
+func (c *Cloud) ListSnapshots(ctx context.Context) ([]driver.Snapshot, error) {
+	var snapshots []driver.Snapshot
+	err := c.read(ctx, OpListSnapshots, func() {
+		snapshots = make([]driver.Snapshot, 0, len(c.snapshots))
+		for _, snapshot := range c.snapshots {
+			snapshots = append(snapshots, *snapshot)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].ID > snapshots[j].ID
+	})
+
+	return snapshots, nil
+}
+
+// DeleteSnapshot implements driver.BlockStorage
+func (c *Cloud) DeleteSnapshot(ctx context.Context, volumeID, snapshotID string) error {
+	if err := c.call(ctx, OpDeleteSnapshot); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if snapshot, ok := c.snapshots[snapshotID]; !ok || snapshot.EbsID != volumeID {
+		return APIError(http.StatusNotFound, "Snapshot not found")
+	}
+
+	delete(c.snapshots, snapshotID)
+	return nil
+}
+
+// ListQuotas implements driver.BlockStorage
+func (c *Cloud) ListQuotas(ctx context.Context) ([]driver.Quota, error) {
+	var quotas []driver.Quota
+	err := c.read(ctx, OpListQuotas, func() {
+		quotas = make([]driver.Quota, 0, len(c.quotas))
+		for dcslug, limit := range c.quotas {
+			quotas = append(quotas, driver.Quota{
+				Dcslug: dcslug,
+				Limit:  strconv.Itoa(limit),
+				Used:   strconv.Itoa(c.usedGB(dcslug)),
+			})
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(quotas, func(i, j int) bool {
+		return quotas[i].Dcslug < quotas[j].Dcslug
+	})
+
+	return quotas, nil
+}
+
+// call counts the call, waits for the injected latency and returns the injected error of op.
+// The change a write makes happens once the latency is over
+func (c *Cloud) call(ctx context.Context, op string) error {
+	c.mu.Lock()
+	latency, err := c.start(op)
+	c.mu.Unlock()
+
+	if waitErr := c.wait(ctx, latency); waitErr != nil {
+		return waitErr
+	}
+	return err
+}
+
+// read is call for reads, the answer is the state when the request arrived but only
+// comes back once the latency is over, like a listing that is already stale on arrival
+func (c *Cloud) read(ctx context.Context, op string, snapshot func()) error {
+	c.mu.Lock()
+	latency, err := c.start(op)
+	if err == nil {
+		snapshot()
+	}
+	c.mu.Unlock()
+
+	if waitErr := c.wait(ctx, latency); waitErr != nil {
+		return waitErr
+	}
+	return err
+}
+
+// start counts the call and returns the latency and injected error of op, c.mu must be held
+func (c *Cloud) start(op string) (time.Duration, error) {
+	c.calls[op]++
+
+	if queued := c.errorsOnce[op]; len(queued) > 0 {
+		c.errorsOnce[op] = queued[1:]
+		return c.latency, queued[0]
+	}
+	return c.latency, c.errors[op]
+}
+
+// wait waits for the latency, a context done before that fails the call the way a
+// cancelled request would
+func (c *Cloud) wait(ctx context.Context, latency time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if latency > 0 {
+		select {
+		case <-time.After(latency):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	return nil
+}
+
+func (c *Cloud) newID() string {
+	c.nextID++
+	return strconv.Itoa(c.nextID)
+}
+
+// usedGB is the size of every volume in the datacenter, c.mu must be held
+func (c *Cloud) usedGB(dcslug string) int {
+	used := 0
+	for _, volume := range c.volumes {
+		if volume.Location.Dc == dcslug {
+			size, _ := strconv.Atoi(volume.Size)
+			used += size
+		}
+	}
+	return used
+}
+
+// hasNode reports whether a worker of any cluster has the cloudid, c.mu must be held
+func (c *Cloud) hasNode(nodeID string) bool {
+	for _, cluster := range c.clusters {
+		for _, nodepool := range cluster.Nodepools {
+			for _, worker := range nodepool.Workers {
+				if worker.Cloudid == nodeID {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}